@@ -0,0 +1,370 @@
+// Package admin implements the local HTTP API to inspect and manage a running mmp-go.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
+)
+
+const UnixPrefix = "unix:"
+
+// DispatcherInfo describes the dispatchers listening on an address.
+type DispatcherInfo struct {
+	Addr      string   `json:"addr"`
+	Port      int      `json:"port"`
+	Group     string   `json:"group"`
+	Protocols []string `json:"protocols"`
+}
+
+// UpstreamError describes an upstream failed to pull during a reload.
+type UpstreamError struct {
+	Group    string `json:"group"`
+	Upstream string `json:"upstream"`
+	Error    string `json:"error"`
+}
+
+// ListenError is an address failed to listen on when reloading.
+type ListenError struct {
+	Group string `json:"group"`
+	Addr  string `json:"addr"`
+	Error string `json:"error"`
+}
+
+// ReloadResult describes what a reload changed.
+type ReloadResult struct {
+	Groups         int             `json:"groups"`
+	Servers        int             `json:"servers"`
+	AddedAddrs     []string        `json:"addedAddrs"`
+	UpdatedAddrs   []string        `json:"updatedAddrs"`
+	RemovedAddrs   []string        `json:"removedAddrs"`
+	UpstreamErrors []UpstreamError `json:"upstreamErrors"`
+	ListenErrors   []ListenError   `json:"listenErrors"`
+}
+
+type GroupInfo struct {
+	Name      string         `json:"name"`
+	Port      int            `json:"port"`
+	Listen    []string       `json:"listen"`
+	Servers   int            `json:"servers"`
+	Upstreams []UpstreamInfo `json:"upstreams"`
+}
+
+type UpstreamInfo struct {
+	Name         string     `json:"name"`
+	Type         string     `json:"type"`
+	PullingTime  *time.Time `json:"pullingTime,omitempty"`
+	PullingError string     `json:"pullingError,omitempty"`
+}
+
+type ServerInfo struct {
+	Group    string             `json:"group"`
+	Name     string             `json:"name"`
+	Target   string             `json:"target"`
+	Targets  []TargetInfo       `json:"targets"`
+	Method   string             `json:"method"`
+	Disabled bool               `json:"disabled"`
+	Upstream *UpstreamInfo      `json:"upstream,omitempty"`
+	Quota    *config.QuotaUsage `json:"quota,omitempty"`
+	Exceeded bool               `json:"exceeded"`
+}
+
+type TargetInfo struct {
+	Addr    string `json:"addr"`
+	Conns   int    `json:"conns"`
+	Healthy bool   `json:"healthy"`
+}
+
+type ConnInfo struct {
+	ID       uint64    `json:"id"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Group    string    `json:"group"`
+	Server   string    `json:"server"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	Up       uint64    `json:"up"`
+	Down     uint64    `json:"down"`
+}
+
+// Server serves the admin API. The hooks are provided by the main package, which owns the dispatchers.
+type Server struct {
+	// Token is compared with the bearer token of requests if not empty.
+	Token string
+
+	Dispatchers       func() []DispatcherInfo
+	Reload            func() (*ReloadResult, error)
+	SetServerDisabled func(group string, server string, disabled bool) int
+
+	// Conns is the registry of connections. Default: conntrack.Default
+	Conns *conntrack.Registry
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/groups", s.method(http.MethodGet, s.handleGroups))
+	mux.HandleFunc("/v1/servers", s.method(http.MethodGet, s.handleServers))
+	mux.HandleFunc("/v1/dispatchers", s.method(http.MethodGet, s.handleDispatchers))
+	mux.HandleFunc("/v1/reload", s.method(http.MethodPost, s.handleReload))
+	mux.HandleFunc("/v1/servers/disable", s.method(http.MethodPost, s.handleSetDisabled(true)))
+	mux.HandleFunc("/v1/servers/enable", s.method(http.MethodPost, s.handleSetDisabled(false)))
+	mux.HandleFunc("/v1/conns", s.method(http.MethodGet, s.handleConns))
+	mux.HandleFunc("/v1/conns/kill", s.method(http.MethodPost, s.handleKillConns))
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) method(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	conf := config.GetConfig()
+	groups := make([]GroupInfo, 0, len(conf.Groups))
+	for i := range conf.Groups {
+		g := &conf.Groups[i]
+		info := GroupInfo{
+			Name:      g.Name,
+			Port:      g.Port,
+			Listen:    make([]string, 0, 1),
+			Servers:   len(g.Servers),
+			Upstreams: make([]UpstreamInfo, 0, len(g.Upstreams)),
+		}
+		for _, addr := range g.ListenAddrs() {
+			info.Listen = append(info.Listen, addr.String())
+		}
+		for j := range g.Upstreams {
+			info.Upstreams = append(info.Upstreams, newUpstreamInfo(&g.Upstreams[j]))
+		}
+		groups = append(groups, info)
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	conf := config.GetConfig()
+	group := r.URL.Query().Get("group")
+	servers := make([]ServerInfo, 0)
+	for i := range conf.Groups {
+		g := &conf.Groups[i]
+		if group != "" && g.Name != group {
+			continue
+		}
+		for j := range g.Servers {
+			server := &g.Servers[j]
+			info := ServerInfo{
+				Group:    g.Name,
+				Name:     server.Name,
+				Target:   server.Target,
+				Targets:  make([]TargetInfo, 0, 1),
+				Method:   server.Method,
+				Disabled: server.Disabled(),
+			}
+			for _, t := range server.TargetList() {
+				info.Targets = append(info.Targets, TargetInfo{Addr: t.Addr, Conns: t.Conns(), Healthy: t.Healthy()})
+			}
+			if server.UpstreamConf != nil {
+				upstream := newUpstreamInfo(server.UpstreamConf)
+				info.Upstream = &upstream
+			}
+			if server.HasQuota() {
+				usage := config.Quota().Usage(server.QuotaID())
+				info.Quota = &usage
+				info.Exceeded = config.Quota().Exceeded(server)
+			}
+			servers = append(servers, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func (s *Server) handleDispatchers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Dispatchers())
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	result, err := s.Reload()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleSetDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group, server := r.URL.Query().Get("group"), r.URL.Query().Get("server")
+		if group == "" || server == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("group and server are required"))
+			return
+		}
+		if s.SetServerDisabled(group, server, disabled) == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("server %v not found in group %v", server, group))
+			return
+		}
+		log.Printf("[admin] set server %v in group %v disabled: %v", server, group, disabled)
+		writeJSON(w, http.StatusOK, map[string]bool{"disabled": disabled})
+	}
+}
+
+func (s *Server) handleConns(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newConnInfos(s.registry().List(filter)))
+}
+
+func (s *Server) handleKillConns(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.Empty() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("one of id, client, group and server is required"))
+		return
+	}
+	conns := s.registry().Kill(filter)
+	log.Printf("[admin] killed %d connections", len(conns))
+	writeJSON(w, http.StatusOK, newConnInfos(conns))
+}
+
+func (s *Server) registry() *conntrack.Registry {
+	if s.Conns != nil {
+		return s.Conns
+	}
+	return conntrack.Default
+}
+
+func parseFilter(r *http.Request) (filter conntrack.Filter, err error) {
+	q := r.URL.Query()
+	if id := q.Get("id"); id != "" {
+		if filter.ID, err = strconv.ParseUint(id, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid id: %v", id)
+		}
+	}
+	if client := q.Get("client"); client != "" {
+		if filter.ClientIP = net.ParseIP(client); filter.ClientIP == nil {
+			return filter, fmt.Errorf("invalid client IP: %v", client)
+		}
+	}
+	filter.Group = q.Get("group")
+	filter.Server = q.Get("server")
+	return filter, nil
+}
+
+func newConnInfos(conns []*conntrack.Conn) []ConnInfo {
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, ConnInfo{
+			ID:       c.ID,
+			Protocol: c.Protocol,
+			Client:   c.Client.String(),
+			Group:    c.Group,
+			Server:   c.Server,
+			Target:   c.Target,
+			Start:    c.Start,
+			Up:       c.Up(),
+			Down:     c.Down(),
+		})
+	}
+	return infos
+}
+
+func newUpstreamInfo(uc *config.UpstreamConf) UpstreamInfo {
+	info := UpstreamInfo{
+		Name: uc.Name,
+		Type: uc.Type,
+	}
+	if !uc.PullingTime.IsZero() {
+		t := uc.PullingTime
+		info.PullingTime = &t
+	}
+	if uc.PullingError != nil {
+		info.PullingError = uc.PullingError.Error()
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[admin] failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Listen listens on a unix socket ("unix:/path/to/socket") or a loopback address.
+// A token is required unless listening on a unix socket.
+func Listen(addr string, token string) (net.Listener, error) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		path := strings.TrimPrefix(addr, UnixPrefix)
+		// remove the socket left by the last run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	if token == "" {
+		return nil, fmt.Errorf("admin token is required to listen on %v", addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("admin API must listen on a loopback address or a unix socket: %v", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve serves the admin API on the listener, which should be created by Listen.
+func (s *Server) Serve(l net.Listener) error {
+	log.Printf("[admin] listen on %v\n", l.Addr())
+	return http.Serve(l, s.Handler())
+}
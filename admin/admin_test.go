@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
+)
+
+func newTestServer(t *testing.T) (*Server, *config.Config) {
+	conf := &config.Config{
+		Groups: []config.Group{{
+			Name: "admin-test",
+			Port: 20001,
+			Servers: []config.Server{
+				{Name: "a", Target: "127.0.0.1:1", Method: "aes-128-gcm", Password: "a"},
+				{Name: "b", Target: "127.0.0.1:2", Method: "aes-128-gcm", Password: "b"},
+			},
+			Upstreams: []config.UpstreamConf{{Name: "u", Type: "outline", PullingError: fmt.Errorf("unreachable")}},
+		}},
+	}
+	config.SetConfig(conf)
+	t.Cleanup(func() {
+		conf.SetServerDisabled("admin-test", "a", false)
+		config.SetConfig(nil)
+	})
+	s := &Server{
+		Token: "secret",
+		Dispatchers: func() []DispatcherInfo {
+			return []DispatcherInfo{{Addr: ":20001", Port: 20001, Group: "admin-test", Protocols: []string{"tcp", "udp"}}}
+		},
+		Reload: func() (*ReloadResult, error) {
+			return &ReloadResult{Groups: 1, Servers: 2, UpdatedAddrs: []string{":20001"}}, nil
+		},
+		SetServerDisabled: func(group string, server string, disabled bool) int {
+			return config.GetConfig().SetServerDisabled(group, server, disabled)
+		},
+	}
+	return s, conf
+}
+
+func do(t *testing.T, h http.Handler, method string, target string, token string, v interface{}) int {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestServer_Token(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	if code := do(t, h, http.MethodGet, "/v1/groups", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without token, got %v", code)
+	}
+	if code := do(t, h, http.MethodGet, "/v1/groups", "wrong", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 with wrong token, got %v", code)
+	}
+	if code := do(t, h, http.MethodGet, "/v1/groups", "secret", nil); code != http.StatusOK {
+		t.Fatalf("expect 200, got %v", code)
+	}
+}
+
+func TestServer_List(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	var groups []GroupInfo
+	if code := do(t, h, http.MethodGet, "/v1/groups", "secret", &groups); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	if len(groups) != 1 || groups[0].Servers != 2 || groups[0].Upstreams[0].PullingError != "unreachable" {
+		t.Fatalf("unexpected groups: %+v", groups)
+	}
+
+	var servers []ServerInfo
+	do(t, h, http.MethodGet, "/v1/servers?group=admin-test", "secret", &servers)
+	if len(servers) != 2 || servers[1].Name != "b" || servers[1].Target != "127.0.0.1:2" {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+
+	var dispatchers []DispatcherInfo
+	do(t, h, http.MethodGet, "/v1/dispatchers", "secret", &dispatchers)
+	if len(dispatchers) != 1 || dispatchers[0].Port != 20001 {
+		t.Fatalf("unexpected dispatchers: %+v", dispatchers)
+	}
+
+	var result ReloadResult
+	if code := do(t, h, http.MethodGet, "/v1/reload", "secret", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expect 405, got %v", code)
+	}
+	do(t, h, http.MethodPost, "/v1/reload", "secret", &result)
+	if result.Groups != 1 || len(result.UpdatedAddrs) != 1 {
+		t.Fatalf("unexpected reload result: %+v", result)
+	}
+}
+
+func TestServer_SetDisabled(t *testing.T) {
+	s, conf := newTestServer(t)
+	h := s.Handler()
+
+	if code := do(t, h, http.MethodPost, "/v1/servers/disable?group=admin-test&server=a", "secret", nil); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	g := &conf.Groups[0]
+	if !g.Servers[0].Disabled() || g.Servers[1].Disabled() {
+		t.Fatal("server a should be disabled only")
+	}
+	if g.FallbackServer() != &g.Servers[1] {
+		t.Fatal("fallback should skip the disabled server")
+	}
+
+	// the state survives rebuilding the group
+	rebuilt := *g
+	rebuilt.Servers = append([]config.Server(nil), g.Servers...)
+	rebuilt.Servers[0] = config.Server{Name: "a"}
+	rebuilt.BuildDisabledServers()
+	if !rebuilt.Servers[0].Disabled() {
+		t.Fatal("server a should stay disabled after rebuilding")
+	}
+
+	if code := do(t, h, http.MethodPost, "/v1/servers/enable?group=admin-test&server=a", "secret", nil); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	if g.Servers[0].Disabled() {
+		t.Fatal("server a should be enabled")
+	}
+	if code := do(t, h, http.MethodPost, "/v1/servers/enable?group=admin-test&server=c", "secret", nil); code != http.StatusNotFound {
+		t.Fatalf("expect 404, got %v", code)
+	}
+}
+
+func TestListen(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0", "secret"); err == nil {
+		t.Fatal("should refuse non-loopback addresses")
+	}
+	if _, err := Listen("127.0.0.1:0", ""); err == nil {
+		t.Fatal("should require a token on TCP")
+	}
+	l, err := Listen("127.0.0.1:0", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l, err = Listen(UnixPrefix+filepath.Join(t.TempDir(), "admin.sock"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestConnsCommand(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Token = ""
+	s.Conns = conntrack.NewRegistry()
+	var killed []string
+	for _, c := range []struct{ ip, server string }{{"10.0.0.1", "a"}, {"10.0.0.2", "b"}} {
+		c := c
+		entry := s.Conns.Add(&conntrack.Conn{
+			Protocol: "tcp",
+			Client:   &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 1000},
+			Group:    "admin-test",
+			Server:   c.server,
+			Target:   "127.0.0.1:1",
+		}, func() { killed = append(killed, c.ip) })
+		entry.AddUp(100)
+	}
+
+	addr := UnixPrefix + filepath.Join(t.TempDir(), "admin.sock")
+	l, err := Listen(addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, s.Handler())
+	defer l.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := ConnsCommand([]string{"list", "-admin", addr}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %v: %v", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "10.0.0.1:1000") || !strings.Contains(stdout.String(), "10.0.0.2:1000") {
+		t.Fatalf("unexpected output: %v", stdout.String())
+	}
+	if code := ConnsCommand([]string{"kill", "-admin", addr}, &stdout, &stderr); code != 2 {
+		t.Fatal("kill without a filter should fail")
+	}
+	stdout.Reset()
+	if code := ConnsCommand([]string{"kill", "-admin", addr, "-server", "b"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %v: %v", code, stderr.String())
+	}
+	if len(killed) != 1 || killed[0] != "10.0.0.2" || len(s.Conns.List(conntrack.Filter{})) != 1 {
+		t.Fatalf("unexpected killed: %v", killed)
+	}
+	if !strings.HasPrefix(stdout.String(), "killed 1 connections") {
+		t.Fatalf("unexpected output: %v", stdout.String())
+	}
+}
@@ -0,0 +1,177 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+)
+
+// Client calls the admin API of a running mmp-go.
+type Client struct {
+	Addr  string
+	Token string
+	http  *http.Client
+	base  string
+}
+
+func NewClient(addr string, token string) *Client {
+	c := &Client{Addr: addr, Token: token, base: "http://" + addr}
+	transport := &http.Transport{}
+	if strings.HasPrefix(addr, UnixPrefix) {
+		path := strings.TrimPrefix(addr, UnixPrefix)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		c.base = "http://mmp-go"
+	}
+	c.http = &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	return c
+}
+
+// Do sends a request to the path and decodes the JSON response into v.
+func (c *Client) Do(method string, path string, query url.Values, v interface{}) error {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+		}
+		return fmt.Errorf("%v %v: %v", method, path, e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+const connsUsage = `Usage: mmp-go conns list|kill [options]
+
+List or terminate connections of a running mmp-go through its admin API.
+kill requires at least one of -id, -client, -group and -server.
+
+Options:
+`
+
+// ConnsCommand runs the "conns" subcommand and returns the exit code.
+func ConnsCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("conns", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, connsUsage)
+		fs.PrintDefaults()
+	}
+	confPath := fs.String("conf", "example.json", "config file path to read the admin API address and token from")
+	addr := fs.String("admin", "", "admin API address, e.g. unix:/run/mmp-go/admin.sock (default: admin.listen of the config)")
+	token := fs.String("token", "", "admin API token (default: admin.token of the config)")
+	id := fs.Uint64("id", 0, "connection ID")
+	client := fs.String("client", "", "client IP")
+	group := fs.String("group", "", "group name")
+	server := fs.String("server", "", "server name")
+
+	if len(args) == 0 || (args[0] != "list" && args[0] != "kill") {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *addr == "" || *token == "" {
+		conf, err := readAdminConf(*confPath)
+		if err != nil && *addr == "" {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if *addr == "" {
+			*addr = conf.Listen
+		}
+		if *token == "" {
+			*token = conf.Token
+		}
+	}
+	if *addr == "" {
+		fmt.Fprintln(stderr, "admin API is not enabled")
+		return 1
+	}
+
+	query := url.Values{}
+	if *id != 0 {
+		query.Set("id", fmt.Sprint(*id))
+	}
+	for k, v := range map[string]string{"client": *client, "group": *group, "server": *server} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	method, path := http.MethodGet, "/v1/conns"
+	if action == "kill" {
+		if len(query) == 0 {
+			fs.Usage()
+			return 2
+		}
+		method, path = http.MethodPost, "/v1/conns/kill"
+	}
+
+	var conns []ConnInfo
+	if err := NewClient(*addr, *token).Do(method, path, query, &conns); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if action == "kill" {
+		fmt.Fprintf(stdout, "killed %d connections\n", len(conns))
+	}
+	writeConns(stdout, conns)
+	return 0
+}
+
+func writeConns(w io.Writer, conns []ConnInfo) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPROTOCOL\tCLIENT\tGROUP\tSERVER\tTARGET\tDURATION\tUP\tDOWN")
+	for _, c := range conns {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.ID, c.Protocol, c.Client, c.Group, c.Server, c.Target,
+			time.Since(c.Start).Truncate(time.Second), c.Up, c.Down)
+	}
+	tw.Flush()
+}
+
+func readAdminConf(confPath string) (conf config.AdminConf, err error) {
+	b, err := os.ReadFile(confPath)
+	if err != nil {
+		return conf, err
+	}
+	var c struct {
+		Admin config.AdminConf `json:"admin"`
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return conf, err
+	}
+	return c.Admin, nil
+}
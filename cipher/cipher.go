@@ -19,6 +19,13 @@ type CipherConf struct {
 	TagLen           int
 	NewCipher        func(key []byte) (cipher.AEAD, error)
 	NewPartialCipher func(key []byte) (smaead.PartialAEAD, error)
+
+	// SIP022 marks the Shadowsocks 2022 edition methods.
+	SIP022 bool
+	// NewBlockCipher encrypts the separate header of SIP022 UDP packets. It is nil for chacha20-poly1305.
+	NewBlockCipher func(key []byte) (cipher.Block, error)
+	// NewPacketCipher is used by SIP022 UDP packets without a separate header.
+	NewPacketCipher func(key []byte) (cipher.AEAD, error)
 }
 
 const (
@@ -34,6 +41,10 @@ var (
 		"chacha20-poly1305":      {KeyLen: 32, SaltLen: 32, NonceLen: 12, TagLen: 16, NewCipher: chacha20poly1305.New, NewPartialCipher: NewPC20P1305},
 		"aes-256-gcm":            {KeyLen: 32, SaltLen: 32, NonceLen: 12, TagLen: 16, NewCipher: NewGcm, NewPartialCipher: NewPGcm},
 		"aes-128-gcm":            {KeyLen: 16, SaltLen: 16, NonceLen: 12, TagLen: 16, NewCipher: NewGcm, NewPartialCipher: NewPGcm},
+
+		"2022-blake3-aes-128-gcm":       {KeyLen: 16, SaltLen: 16, NonceLen: 12, TagLen: 16, NewCipher: NewGcm, SIP022: true, NewBlockCipher: aes.NewCipher},
+		"2022-blake3-aes-256-gcm":       {KeyLen: 32, SaltLen: 32, NonceLen: 12, TagLen: 16, NewCipher: NewGcm, SIP022: true, NewBlockCipher: aes.NewCipher},
+		"2022-blake3-chacha20-poly1305": {KeyLen: 32, SaltLen: 32, NonceLen: 12, TagLen: 16, NewCipher: chacha20poly1305.New, SIP022: true, NewPacketCipher: chacha20poly1305.NewX},
 	}
 	ZeroNonce  [MaxNonceSize]byte
 	ReusedInfo = []byte("ss-subkey")
@@ -46,13 +57,7 @@ func (conf *CipherConf) Verify(buf []byte, masterKey []byte, salt []byte, cipher
 	} else {
 		sk = pool.Get(conf.KeyLen)
 		defer pool.Put(sk)
-		kdf := hkdf.New(
-			sha1.New,
-			masterKey,
-			salt,
-			ReusedInfo,
-		)
-		io.ReadFull(kdf, sk)
+		conf.DeriveSubKey(sk, masterKey, salt)
 		if subKey != nil && cap(*subKey) >= conf.KeyLen {
 			*subKey = (*subKey)[:conf.KeyLen]
 			copy(*subKey, sk)
@@ -78,13 +83,7 @@ func (conf *CipherConf) UnsafeVerifyATyp(buf []byte, masterKey []byte, salt []by
 	} else {
 		sk = pool.Get(conf.KeyLen)
 		defer pool.Put(sk)
-		kdf := hkdf.New(
-			sha1.New,
-			masterKey,
-			salt,
-			ReusedInfo,
-		)
-		io.ReadFull(kdf, sk)
+		conf.DeriveSubKey(sk, masterKey, salt)
 		if subKey != nil && cap(*subKey) >= conf.KeyLen {
 			*subKey = (*subKey)[:conf.KeyLen]
 			copy(*subKey, sk)
@@ -101,6 +100,38 @@ func (conf *CipherConf) UnsafeVerifyATyp(buf []byte, masterKey []byte, salt []by
 	return false
 }
 
+// TCPHeaderLen returns the length of the salt and the first encrypted chunk needed to authenticate a TCP request.
+func (conf *CipherConf) TCPHeaderLen() int {
+	if conf.SIP022 {
+		return conf.SaltLen + TCPRequestFixedHeaderLen + conf.TagLen
+	}
+	return conf.SaltLen + 2 + conf.TagLen
+}
+
+// DeriveSubKey derives the session subkey from the master key and the salt into sk.
+func (conf *CipherConf) DeriveSubKey(sk []byte, masterKey []byte, salt []byte) {
+	if conf.SIP022 {
+		deriveSessionSubKey(sk, masterKey, salt)
+		return
+	}
+	kdf := hkdf.New(
+		sha1.New,
+		masterKey,
+		salt,
+		ReusedInfo,
+	)
+	io.ReadFull(kdf, sk)
+}
+
+// MasterKey returns the master key of the password.
+// For SIP022 methods the password is a base64-encoded PSK instead.
+func (conf *CipherConf) MasterKey(password string) ([]byte, error) {
+	if conf.SIP022 {
+		return DecodePSK(password, conf.KeyLen)
+	}
+	return EVPBytesToKey(password, conf.KeyLen), nil
+}
+
 func MD5Sum(d []byte) []byte {
 	h := md5.New()
 	h.Write(d)
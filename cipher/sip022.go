@@ -0,0 +1,207 @@
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/infra/pool"
+	"lukechampine.com/blake3"
+)
+
+/*
+   https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+*/
+
+const (
+	HeaderTypeClient = 0
+	HeaderTypeServer = 1
+
+	// TCPRequestFixedHeaderLen is the length of [type][timestamp][length] in a SIP022 TCP request.
+	TCPRequestFixedHeaderLen = 1 + 8 + 2
+	// UDPSeparateHeaderLen is the length of [session ID][packet ID] in a SIP022 UDP packet.
+	UDPSeparateHeaderLen = 8 + 8
+	// UDPMainHeaderLen is the length of [type][timestamp][padding length] in a SIP022 UDP packet.
+	UDPMainHeaderLen = 1 + 8 + 2
+	XNonceLen        = 24
+	// IdentityHeaderLen is the length of an extensible identity header.
+	IdentityHeaderLen = 16
+
+	// MaxTimeDiff is the maximum allowed difference between the timestamp in a request and the local time.
+	MaxTimeDiff = 30 * time.Second
+)
+
+const (
+	SessionSubKeyContext  = "shadowsocks 2022 session subkey"
+	IdentitySubKeyContext = "shadowsocks 2022 identity subkey"
+)
+
+// PSKHash is the first 16 bytes of the BLAKE3 hash of a PSK, which is carried by identity headers.
+type PSKHash [IdentityHeaderLen]byte
+
+func NewPSKHash(psk []byte) (h PSKHash) {
+	sum := blake3.Sum256(psk)
+	copy(h[:], sum[:])
+	return h
+}
+
+// DecodePSK decodes a base64-encoded pre-shared key and checks its length.
+func DecodePSK(password string, keyLen int) ([]byte, error) {
+	psk, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PSK: %w", err)
+	}
+	if len(psk) != keyLen {
+		return nil, fmt.Errorf("bad PSK length: expect %v, got %v", keyLen, len(psk))
+	}
+	return psk, nil
+}
+
+func deriveSessionSubKey(sk []byte, masterKey []byte, salt []byte) {
+	deriveKey(sk, SessionSubKeyContext, masterKey, salt)
+}
+
+func deriveKey(sk []byte, ctx string, key []byte, salt []byte) {
+	material := pool.Get(len(key) + len(salt))
+	defer pool.Put(material)
+	copy(material, key)
+	copy(material[len(key):], salt)
+	blake3.DeriveKey(sk, ctx, material)
+}
+
+// ValidTimestamp reports whether the big-endian unix timestamp b is close enough to the local time.
+func ValidTimestamp(b []byte) bool {
+	diff := time.Since(time.Unix(int64(binary.BigEndian.Uint64(b)), 0))
+	return diff <= MaxTimeDiff && diff >= -MaxTimeDiff
+}
+
+// VerifyTCPRequestHeader authenticates the fixed-length header chunk of a SIP022 TCP request.
+// cipherText should be [encrypted fixed-length header][tag].
+func (conf *CipherConf) VerifyTCPRequestHeader(buf []byte, masterKey []byte, salt []byte, cipherText []byte) ([]byte, bool) {
+	plain, ok := conf.Verify(buf, masterKey, salt, cipherText, nil)
+	if !ok || len(plain) != TCPRequestFixedHeaderLen {
+		return nil, false
+	}
+	if plain[0] != HeaderTypeClient || !ValidTimestamp(plain[1:9]) {
+		return nil, false
+	}
+	return plain, true
+}
+
+// VerifyUDPPacket authenticates a SIP022 UDP packet.
+// It returns the decrypted [SOCKS address][payload] on success.
+func (conf *CipherConf) VerifyUDPPacket(buf []byte, masterKey []byte, packet []byte) ([]byte, bool) {
+	if conf.NewBlockCipher != nil {
+		//[encrypted separate header][encrypted body][tag]
+		if len(packet) < UDPSeparateHeaderLen+UDPMainHeaderLen+conf.TagLen {
+			return nil, false
+		}
+		block, err := conf.NewBlockCipher(masterKey)
+		if err != nil {
+			return nil, false
+		}
+		var header [UDPSeparateHeaderLen]byte
+		block.Decrypt(header[:], packet[:UDPSeparateHeaderLen])
+		return conf.VerifyUDPBody(buf, masterKey, header[:], packet[UDPSeparateHeaderLen:])
+	}
+	//[nonce][encrypted separate header][encrypted body][tag]
+	if len(packet) < XNonceLen+UDPSeparateHeaderLen+UDPMainHeaderLen+conf.TagLen {
+		return nil, false
+	}
+	ciph, err := conf.NewPacketCipher(masterKey)
+	if err != nil {
+		return nil, false
+	}
+	plain, err := ciph.Open(buf[:0], packet[:XNonceLen], packet[XNonceLen:], nil)
+	if err != nil {
+		return nil, false
+	}
+	return verifyUDPMainHeader(plain[UDPSeparateHeaderLen:])
+}
+
+// DecryptUDPSeparateHeader decrypts the [session ID][packet ID] of a SIP022 UDP packet into header.
+// Packets of 2022-blake3-chacha20-poly1305 are decrypted as a whole, so it is not cheap for them.
+func (conf *CipherConf) DecryptUDPSeparateHeader(header []byte, masterKey []byte, packet []byte) bool {
+	if conf.NewBlockCipher != nil {
+		if len(packet) < UDPSeparateHeaderLen {
+			return false
+		}
+		block, err := conf.NewBlockCipher(masterKey)
+		if err != nil {
+			return false
+		}
+		block.Decrypt(header[:UDPSeparateHeaderLen], packet[:UDPSeparateHeaderLen])
+		return true
+	}
+	if len(packet) < XNonceLen+UDPSeparateHeaderLen+conf.TagLen {
+		return false
+	}
+	ciph, err := conf.NewPacketCipher(masterKey)
+	if err != nil {
+		return false
+	}
+	buf := pool.Get(len(packet))
+	defer pool.Put(buf)
+	plain, err := ciph.Open(buf[:0], packet[:XNonceLen], packet[XNonceLen:], nil)
+	if err != nil {
+		return false
+	}
+	copy(header[:UDPSeparateHeaderLen], plain)
+	return true
+}
+
+// VerifyUDPBody authenticates the body of a SIP022 UDP packet with a separate header.
+// header should be the decrypted separate header.
+func (conf *CipherConf) VerifyUDPBody(buf []byte, masterKey []byte, header []byte, body []byte) ([]byte, bool) {
+	if len(body) < UDPMainHeaderLen+conf.TagLen {
+		return nil, false
+	}
+	sk := pool.Get(conf.KeyLen)
+	defer pool.Put(sk)
+	conf.DeriveSubKey(sk, masterKey, header[:8])
+	ciph, _ := conf.NewCipher(sk)
+	plain, err := ciph.Open(buf[:0], header[4:16], body, nil)
+	if err != nil {
+		return nil, false
+	}
+	return verifyUDPMainHeader(plain)
+}
+
+func verifyUDPMainHeader(plain []byte) ([]byte, bool) {
+	//[type][timestamp][padding length][padding][SOCKS address][payload]
+	if plain[0] != HeaderTypeClient || !ValidTimestamp(plain[1:9]) {
+		return nil, false
+	}
+	paddingLen := int(binary.BigEndian.Uint16(plain[9:11]))
+	if len(plain) < UDPMainHeaderLen+paddingLen {
+		return nil, false
+	}
+	return plain[UDPMainHeaderLen+paddingLen:], true
+}
+
+// DecryptTCPIdentityHeader decrypts the identity header following the salt of a TCP request.
+// Identity headers are only supported by 2022-blake3-aes-*-gcm.
+func DecryptTCPIdentityHeader(identityKey []byte, salt []byte, header []byte) (h PSKHash, err error) {
+	sk := pool.Get(len(identityKey))
+	defer pool.Put(sk)
+	deriveKey(sk, IdentitySubKeyContext, identityKey, salt)
+	block, err := aes.NewCipher(sk)
+	if err != nil {
+		return h, err
+	}
+	block.Decrypt(h[:], header[:IdentityHeaderLen])
+	return h, nil
+}
+
+// DecryptUDPIdentityHeader decrypts the identity header following the separate header of a UDP packet.
+// separateHeader should be the decrypted separate header.
+func DecryptUDPIdentityHeader(identityBlock cipher.Block, separateHeader []byte, header []byte) (h PSKHash) {
+	identityBlock.Decrypt(h[:], header[:IdentityHeaderLen])
+	for i := range h {
+		h[i] ^= separateHeader[i]
+	}
+	return h
+}
@@ -1,26 +1,72 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Qv2ray/mmp-go/cipher"
 	"github.com/Qv2ray/mmp-go/infra/lru"
+	"github.com/Qv2ray/mmp-go/infra/proxyproto"
+	"github.com/Qv2ray/mmp-go/metrics"
 )
 
 type Config struct {
 	ConfPath   string       `json:"-"`
 	HttpClient *http.Client `json:"-"`
 	Groups     []Group      `json:"groups"`
+	Metrics    MetricsConf  `json:"metrics"`
+	Admin      AdminConf    `json:"admin"`
+
+	// DrainTimeoutSec limits how long to wait for active connections to end on exit or when a port is removed by reloading.
+	// Default: 30
+	// Remaining connections are force-closed after the timeout. Set to a negative value to force-close immediately.
+	DrainTimeoutSec int `json:"drainTimeoutSec"`
+
+	// QuotaFile is where the usage of quotas is saved, e.g. "/var/lib/mmp-go/quota.json".
+	// Default: the usage is lost on exit
+	// Changes take effect after restarting.
+	QuotaFile string `json:"quotaFile"`
+
+	// Resolver resolves the targets and caches the answers.
+	Resolver ResolverConf `json:"resolver"`
+}
+
+type AdminConf struct {
+	// Listen is the address of the admin API, e.g. "127.0.0.1:9101" or "unix:/run/mmp-go/admin.sock".
+	// Default: disabled
+	// Only loopback addresses and unix sockets are allowed. Changes take effect after restarting.
+	Listen string `json:"listen"`
+
+	// Token authenticates requests by the "Authorization: Bearer <token>" header.
+	// It is required unless listening on a unix socket.
+	Token string `json:"token"`
+}
+
+type MetricsConf struct {
+	// Listen is the address of the HTTP listener exposing Prometheus metrics, e.g. "127.0.0.1:9100".
+	// Default: disabled
+	// Changes take effect after restarting.
+	Listen string `json:"listen"`
+
+	// Path is the HTTP path of metrics.
+	// Default: /metrics
+	Path string `json:"path"`
 }
 
 type Server struct {
+	// ID identifies the server in the quota store.
+	// Default: the name of the server, or "outline/<server>/<access key ID>" for servers pulled from outline
+	ID           string        `json:"id"`
 	Name         string        `json:"name"`
 	Target       string        `json:"target"`
 	TCPFastOpen  bool          `json:"TCPFastOpen"`
@@ -28,15 +74,67 @@ type Server struct {
 	Password     string        `json:"password"`
 	MasterKey    []byte        `json:"-"`
 	UpstreamConf *UpstreamConf `json:"-"`
+
+	// Targets is more addresses of the same backend besides Target, which are tried in turn if dialing one fails.
+	// Default: Target only
+	Targets []string `json:"targets"`
+
+	// TargetStrategy decides the order to try the targets:
+	//  "failover": in the order of Target and Targets.
+	//  "round-robin": start from the next target for every connection.
+	//  "least-conns": start from the target with the fewest active connections.
+	//  "client-ip-hash": start from the target picked by the hash of the client IP, so a client sticks to a target.
+	// Default: "failover"
+	TargetStrategy string `json:"targetStrategy"`
+	targets        []*Target
+	next           uint32
+
+	// ProxyProtocol sends a PROXY protocol header carrying the client address to the target: "v1", "v2" or "none".
+	// Default: follow the group
+	// UDP packets always carry v2 headers because v1 does not support UDP.
+	ProxyProtocol string `json:"proxyProtocol"`
+
+	// UploadRateLimit and DownloadRateLimit cap the bytes per second sent to and received from the target, over TCP and UDP.
+	// Default: unlimited
+	// They are shared by all connections to servers with the same name in the group.
+	UploadRateLimit   int64 `json:"uploadRateLimit"`
+	DownloadRateLimit int64 `json:"downloadRateLimit"`
+
+	// DailyQuota, MonthlyQuota and TotalQuota cap the bytes of the server in both directions per day, per month and in total.
+	// Default: unlimited
+	// Servers exceeding any of them fail to auth. Days and months are in local time.
+	DailyQuota   int64 `json:"dailyQuota"`
+	MonthlyQuota int64 `json:"monthlyQuota"`
+	TotalQuota   int64 `json:"totalQuota"`
+
+	// Outbound sets the socket options of connections to the target.
+	// Default: follow the group
+	Outbound *OutboundConf `json:"outbound"`
+
+	disabled int32
 }
 
 type Group struct {
-	Name                string           `json:"name"`
-	Port                int              `json:"port"`
-	ListenerTCPFastOpen bool             `json:"listenerTCPFastOpen"`
-	Servers             []Server         `json:"servers"`
-	Upstreams           []UpstreamConf   `json:"upstreams"`
-	UserContextPool     *UserContextPool `json:"-"`
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	// Ports is more ports and port ranges to listen on besides Port, e.g. ["20000-20100", "20200"].
+	// All ports share the servers, replay filter and limits of the group.
+	// At most 1024 ports are allowed per group, including Port.
+	Ports []string `json:"ports"`
+	// Listen is the addresses to listen on, each of which is "ip" listening on all ports of the group, or "ip:port".
+	// Default: all interfaces of both IPv4 and IPv6
+	// IPv4 addresses listen on IPv4 only, and IPv6 ones on IPv6 only, e.g. ["0.0.0.0"] for IPv4 only and ["::"] for IPv6 only.
+	Listen              []string `json:"listen"`
+	ListenerTCPFastOpen bool     `json:"listenerTCPFastOpen"`
+	// ListenerShards is the number of sockets with SO_REUSEPORT per address and protocol, each of which is served by its own goroutine.
+	// Default: 1
+	// Changes take effect on new addresses, after restarting or upgrading.
+	// Inherited sockets without SO_REUSEPORT, e.g. from systemd without ReusePort=yes, cannot be sharded.
+	ListenerShards  int              `json:"listenerShards"`
+	Servers         []Server         `json:"servers"`
+	Upstreams       []UpstreamConf   `json:"upstreams"`
+	UserContextPool *UserContextPool `json:"-"`
+	TCPHeaderLen    int              `json:"-"`
 
 	// AuthTimeoutSec sets a TCP read timeout to drop connections that fail to finish auth in time.
 	// Default: no timeout
@@ -48,10 +146,133 @@ type Group struct {
 	// Set to a value greater than zero to override the platform's default behavior.
 	DialTimeoutSec int `json:"dialTimeoutSec"`
 
-	// DrainOnAuthFail controls whether to fallback to the first server in the group when authentication fails.
-	// Default: fallback to 1st server
-	// Set to true to drain the connection when authentication fails.
+	// Outbound sets the socket options of connections to the targets of servers in the group.
+	// Default: the defaults of the system
+	Outbound *OutboundConf `json:"outbound"`
+
+	// IdleTimeoutSec closes relayed TCP connections without traffic in either direction for the duration.
+	// Default: no timeout
+	IdleTimeoutSec int `json:"idleTimeoutSec"`
+
+	// MaxConnLifetimeSec closes relayed TCP connections lasting for the duration regardless of traffic.
+	// Default: no limit
+	MaxConnLifetimeSec int `json:"maxConnLifetimeSec"`
+
+	// HalfCloseTimeoutSec replaces IdleTimeoutSec once either side of a relayed TCP connection has closed its write end.
+	// Default: no timeout, that is, IdleTimeoutSec keeps applying
+	HalfCloseTimeoutSec int `json:"halfCloseTimeoutSec"`
+
+	// MaxConns caps the TCP connections and UDP sessions of the group in total.
+	// Default: unlimited
+	MaxConns int `json:"maxConns"`
+
+	// MaxTCPConnsPerIP caps the concurrent TCP connections from a client IP.
+	// Default: unlimited
+	MaxTCPConnsPerIP int `json:"maxTCPConnsPerIP"`
+
+	// MaxUDPSessionsPerIP caps the concurrent UDP sessions from a client IP.
+	// Default: unlimited
+	MaxUDPSessionsPerIP int `json:"maxUDPSessionsPerIP"`
+
+	// NewConnRatePerIP caps the new TCP connections and UDP sessions per second from a client IP.
+	// Default: unlimited
+	NewConnRatePerIP float64 `json:"newConnRatePerIP"`
+
+	// NewConnBurstPerIP is the number of new connections allowed in a burst above NewConnRatePerIP.
+	// Default: NewConnRatePerIP rounded up
+	NewConnBurstPerIP int      `json:"newConnBurstPerIP"`
+	Limiter           *Limiter `json:"-"`
+
+	// UploadRateLimit and DownloadRateLimit cap the bytes per second of the group in total, over TCP and UDP.
+	// Default: unlimited
+	// TCP connections are slowed down and UDP packets are dropped when exceeding the limits.
+	UploadRateLimit   int64 `json:"uploadRateLimit"`
+	DownloadRateLimit int64 `json:"downloadRateLimit"`
+
+	// ClientUploadRateLimit and ClientDownloadRateLimit cap the bytes per second of a client IP.
+	// Default: unlimited
+	ClientUploadRateLimit   int64   `json:"clientUploadRateLimit"`
+	ClientDownloadRateLimit int64   `json:"clientDownloadRateLimit"`
+	Shaper                  *Shaper `json:"-"`
+
+	// HealthCheck checks the targets of servers in the group in the background.
+	// Default: disabled
+	HealthCheck *HealthCheckConf `json:"healthCheck"`
+	TargetSet   *TargetSet       `json:"-"`
+
+	// AuthFailPolicy decides what to do with TCP connections failing to auth. Probers may tell servers apart by how they
+	// behave on bad input, e.g. when and how they close the connection.
+	//  "fallback": relay the connection to Fallback, or the first server if Fallback is not set.
+	//  "drain": read and discard forever until the client closes. AuthTimeoutSec does not apply.
+	//  "rst": read a random number of bytes in total up to AuthFailMaxBytes, then close with RST.
+	//  "delay": read and discard for a random duration up to AuthFailMaxDelaySec, then close with FIN.
+	//  "hold": read and discard until AuthTimeoutSec after the connection is accepted, then close with FIN.
+	// Default: "drain", or "hold" with AuthTimeoutSec, if DrainOnAuthFail is set and Fallback is not, otherwise "fallback"
+	AuthFailPolicy string `json:"authFailPolicy"`
+
+	// AuthFailMaxBytes is the upper bound of bytes read by the "rst" policy.
+	// Default: 1024
+	AuthFailMaxBytes int `json:"authFailMaxBytes"`
+
+	// AuthFailMaxDelaySec is the upper bound of the delay of the "delay" policy.
+	// Default: 60
+	AuthFailMaxDelaySec int `json:"authFailMaxDelaySec"`
+
+	// DrainOnAuthFail is the same as AuthFailPolicy "drain", or "hold" if AuthTimeoutSec is set, which it keeps applying.
+	// Deprecated: use AuthFailPolicy instead.
 	DrainOnAuthFail bool `json:"drainOnAuthFail"`
+
+	// Fallback relays unauthenticated connections to a decoy target instead of the first server.
+	// Default: disabled
+	// TCP connections are relayed to it if AuthFailPolicy is "fallback", which is the default if it is set.
+	Fallback *FallbackConf `json:"fallback"`
+
+	// IdentityPSK is the base64-encoded identity PSK of SIP022 extensible identity headers.
+	// Default: disabled
+	// Clients of 2022-blake3-aes-*-gcm servers in the group may use "identityPSK:userPSK" as their password.
+	// The user is then looked up by the identity header instead of trying every server.
+	IdentityPSK string                 `json:"identityPSK"`
+	IdentityKey []byte                 `json:"-"`
+	Identities  map[cipher.PSKHash]int `json:"-"`
+
+	// ReplayFilterCapacity enables the salt replay filter, and sets the number of salts in a generation of it.
+	// Default: disabled
+	// The filter remembers salts of the current and the previous generation, and treats a request with a known salt as failed to auth.
+	// For example, 1000000 salts take about 3.4MiB per generation with the default false positive rate.
+	// SIP022 UDP packets are checked by their session and packet IDs in a sliding window of each session instead.
+	ReplayFilterCapacity int `json:"replayFilterCapacity"`
+
+	// ReplayFilterIntervalSec limits how long a generation of the replay filter lasts.
+	// Default: no time limit, a generation ends only when it is full
+	ReplayFilterIntervalSec int `json:"replayFilterIntervalSec"`
+
+	// ReplayFilterFalsePositiveRate sets the probability that a fresh salt is mistaken as a replay.
+	// Default: 1e-6
+	ReplayFilterFalsePositiveRate float64       `json:"replayFilterFalsePositiveRate"`
+	ReplayFilter                  *ReplayFilter `json:"-"`
+
+	// ProxyProtocol is the default PROXY protocol version sent to the targets of servers in the group: "v1", "v2" or "none".
+	// Default: none
+	ProxyProtocol string `json:"proxyProtocol"`
+
+	// AcceptProxyProtocol accepts PROXY protocol v1/v2 headers on the TCP listener: "required", "optional" or "none".
+	// Default: none
+	// The client address in the header is used instead of the address of the proxy, e.g. a load balancer.
+	AcceptProxyProtocol string `json:"acceptProxyProtocol"`
+
+	// ProxyProtocolTrustedCIDRs lists the sources allowed to send PROXY protocol headers, which is required by AcceptProxyProtocol.
+	// Default: none
+	// Connections from other sources are treated as if they did not send a header. Set ["0.0.0.0/0", "::/0"] to trust all sources.
+	ProxyProtocolTrustedCIDRs []string     `json:"proxyProtocolTrustedCIDRs"`
+	TrustedProxies            []*net.IPNet `json:"-"`
+
+	// ParallelAuthThreshold enables parallel authentication when the group has at least this many servers.
+	// Default: disabled
+	ParallelAuthThreshold int `json:"parallelAuthThreshold"`
+
+	// ParallelAuthWorkers sets the number of workers probing servers in parallel for a connection.
+	// Default: the number of CPUs
+	ParallelAuthWorkers int `json:"parallelAuthWorkers"`
 }
 
 type UpstreamConf struct {
@@ -59,6 +280,7 @@ type UpstreamConf struct {
 	Type         string          `json:"type"`
 	Settings     json.RawMessage `json:"settings"`
 	PullingError error           `json:"-"`
+	PullingTime  time.Time       `json:"-"`
 	Upstream     Upstream        `json:"-"`
 }
 
@@ -67,20 +289,236 @@ func (uc UpstreamConf) Equal(that UpstreamConf) bool {
 }
 
 const (
-	LRUTimeout = 30 * time.Minute
+	LRUTimeout          = 30 * time.Minute
+	DefaultDrainTimeout = 30 * time.Second
+
+	AuthFailFallback = "fallback"
+	AuthFailDrain    = "drain"
+	AuthFailRST      = "rst"
+	AuthFailDelay    = "delay"
+	AuthFailHold     = "hold"
+
+	DefaultAuthFailMaxBytes = 1024
+	DefaultAuthFailMaxDelay = 60 * time.Second
 )
 
 var (
-	config  *Config
+	// config holds the *Config in use, which is replaced on reloading while the admin API reads it
+	config  atomic.Value
 	Version = "debug"
 )
 
+func (config *Config) DrainTimeout() time.Duration {
+	switch {
+	case config.DrainTimeoutSec == 0:
+		return DefaultDrainTimeout
+	case config.DrainTimeoutSec < 0:
+		return 0
+	}
+	return time.Duration(config.DrainTimeoutSec) * time.Second
+}
+
 func (g *Group) BuildMasterKeys() {
 	servers := g.Servers
 	for j := range servers {
 		s := &servers[j]
-		s.MasterKey = cipher.EVPBytesToKey(s.Password, cipher.CiphersConf[s.Method].KeyLen)
+		conf := cipher.CiphersConf[s.Method]
+		s.MasterKey, _ = conf.MasterKey(s.Password)
+	}
+}
+
+// BuildIdentities indexes the servers which can be looked up by identity headers.
+func (g *Group) BuildIdentities() {
+	g.IdentityKey = nil
+	g.Identities = nil
+	if g.IdentityPSK == "" {
+		return
+	}
+	g.IdentityKey, _ = base64.StdEncoding.DecodeString(g.IdentityPSK)
+	g.Identities = make(map[cipher.PSKHash]int)
+	for i, s := range g.Servers {
+		if g.SupportIdentity(&s) {
+			g.Identities[cipher.NewPSKHash(s.MasterKey)] = i
+		}
+	}
+}
+
+// SupportIdentity reports whether the server can be looked up by identity headers.
+func (g *Group) SupportIdentity(s *Server) bool {
+	conf := cipher.CiphersConf[s.Method]
+	return g.IdentityKey != nil && conf.SIP022 && conf.NewBlockCipher != nil && conf.KeyLen == len(g.IdentityKey)
+}
+
+func (g *Group) BuildReplayFilter() {
+	if g.ReplayFilterCapacity <= 0 {
+		g.ReplayFilter = nil
+		return
+	}
+	p := g.ReplayFilterFalsePositiveRate
+	if p <= 0 || p >= 1 {
+		p = DefaultReplayFilterFalsePositiveRate
+	}
+	g.ReplayFilter = NewReplayFilter(g.ReplayFilterCapacity, p, time.Duration(g.ReplayFilterIntervalSec)*time.Second)
+}
+
+// InheritReplayFilter takes over the replay filter of the old group with the same settings to remember salts across reloads.
+func (g *Group) InheritReplayFilter(old *Group) {
+	if g.ReplayFilter == nil || old.ReplayFilter == nil {
+		return
+	}
+	if g.ReplayFilterCapacity != old.ReplayFilterCapacity ||
+		g.ReplayFilterIntervalSec != old.ReplayFilterIntervalSec ||
+		g.ReplayFilterFalsePositiveRate != old.ReplayFilterFalsePositiveRate {
+		return
+	}
+	g.ReplayFilter = old.ReplayFilter
+}
+
+func (g *Group) limits() Limits {
+	return Limits{
+		MaxConns:         g.MaxConns,
+		MaxTCPConnsPerIP: g.MaxTCPConnsPerIP,
+		MaxSessionsPerIP: g.MaxUDPSessionsPerIP,
+		NewConnRate:      g.NewConnRatePerIP,
+		NewConnBurst:     g.NewConnBurstPerIP,
+	}
+}
+
+func (g *Group) BuildLimiter() {
+	g.Limiter = NewLimiter(g.limits())
+}
+
+// InheritLimiter takes over the limiter of the old group with new limits to keep counting existing connections.
+func (g *Group) InheritLimiter(old *Group) {
+	if old.Limiter == nil {
+		return
+	}
+	g.Limiter = old.Limiter
+	g.Limiter.SetLimits(g.limits())
+}
+
+func (g *Group) BuildShaper() {
+	g.Shaper = NewShaper()
+	g.Shaper.Update(g)
+}
+
+// InheritShaper takes over the shaper of the old group with new limits, which apply to existing connections as well.
+func (g *Group) InheritShaper(old *Group) {
+	if old.Shaper == nil {
+		return
+	}
+	g.Shaper = old.Shaper
+	g.Shaper.Update(g)
+}
+
+// BuildTCPHeaderLen finds the length of the longest request header to read before auth.
+func (g *Group) BuildTCPHeaderLen() {
+	g.TCPHeaderLen = 0
+	for _, s := range g.Servers {
+		conf := cipher.CiphersConf[s.Method]
+		l := conf.TCPHeaderLen()
+		if g.SupportIdentity(&s) {
+			l += cipher.IdentityHeaderLen
+		}
+		if l > g.TCPHeaderLen {
+			g.TCPHeaderLen = l
+		}
+	}
+}
+
+// ProxyProtocolVersion returns the PROXY protocol version to send to the target of the server, or 0 if disabled.
+func (g *Group) ProxyProtocolVersion(s *Server) int {
+	version := s.ProxyProtocol
+	if version == "" {
+		version = g.ProxyProtocol
+	}
+	v, _ := proxyproto.ParseVersion(version)
+	return v
+}
+
+// TrustProxy reports whether addr is allowed to send PROXY protocol headers.
+func (g *Group) TrustProxy(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, ipNet := range g.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Group) BuildTrustedProxies() {
+	g.TrustedProxies = nil
+	for _, cidr := range g.ProxyProtocolTrustedCIDRs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			g.TrustedProxies = append(g.TrustedProxies, ipNet)
+		}
+	}
+}
+
+// RelayTimeouts returns the timeouts of relayed TCP connections. Zero means disabled.
+func (g *Group) RelayTimeouts() (idle, lifetime, halfClose time.Duration) {
+	idle = time.Duration(g.IdleTimeoutSec) * time.Second
+	lifetime = time.Duration(g.MaxConnLifetimeSec) * time.Second
+	halfClose = time.Duration(g.HalfCloseTimeoutSec) * time.Second
+	if idle < 0 {
+		idle = 0
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	if halfClose < 0 {
+		halfClose = 0
+	}
+	return idle, lifetime, halfClose
+}
+
+// AuthFailAction returns the AuthFailPolicy in effect.
+func (g *Group) AuthFailAction() string {
+	if g.AuthFailPolicy != "" {
+		return g.AuthFailPolicy
+	}
+	if g.DrainOnAuthFail && (g.Fallback == nil || g.Fallback.Target == "") {
+		if g.AuthTimeoutSec > 0 {
+			// the auth timeout applied to draining before the policies were added
+			return AuthFailHold
+		}
+		return AuthFailDrain
 	}
+	return AuthFailFallback
+}
+
+func (g *Group) AuthFailMaxRead() int {
+	if g.AuthFailMaxBytes > 0 {
+		return g.AuthFailMaxBytes
+	}
+	return DefaultAuthFailMaxBytes
+}
+
+func (g *Group) AuthFailMaxDelay() time.Duration {
+	if g.AuthFailMaxDelaySec > 0 {
+		return time.Duration(g.AuthFailMaxDelaySec) * time.Second
+	}
+	return DefaultAuthFailMaxDelay
+}
+
+// AuthWorkers returns the number of workers to authenticate a connection.
+func (g *Group) AuthWorkers() int {
+	if g.ParallelAuthThreshold <= 0 || len(g.Servers) < g.ParallelAuthThreshold {
+		return 1
+	}
+	if g.ParallelAuthWorkers > 0 {
+		return g.ParallelAuthWorkers
+	}
+	return runtime.NumCPU()
 }
 
 func (g *Group) BuildUserContextPool(timeout time.Duration) {
@@ -98,6 +536,95 @@ func (config *Config) CheckMethodSupported() error {
 	return nil
 }
 
+func (config *Config) CheckKeys() error {
+	for _, g := range config.Groups {
+		for _, s := range g.Servers {
+			conf := cipher.CiphersConf[s.Method]
+			if _, err := conf.MasterKey(s.Password); err != nil {
+				return fmt.Errorf("invalid password of server %v: %w", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) CheckIdentityPSK() error {
+	for _, g := range config.Groups {
+		if g.IdentityPSK == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(g.IdentityPSK)
+		if err != nil {
+			return fmt.Errorf("invalid identityPSK of group %v: %w", g.Name, err)
+		}
+		if len(key) != 16 && len(key) != 32 {
+			return fmt.Errorf("invalid identityPSK of group %v: bad length %v", g.Name, len(key))
+		}
+	}
+	return nil
+}
+
+func (config *Config) CheckProxyProtocol() error {
+	for _, g := range config.Groups {
+		if _, err := proxyproto.ParseVersion(g.ProxyProtocol); err != nil {
+			return fmt.Errorf("group %v: %w", g.Name, err)
+		}
+		for _, s := range g.Servers {
+			if _, err := proxyproto.ParseVersion(s.ProxyProtocol); err != nil {
+				return fmt.Errorf("server %v: %w", s.Name, err)
+			}
+		}
+		switch g.AcceptProxyProtocol {
+		case "", "none":
+		case "optional", "required":
+			if len(g.ProxyProtocolTrustedCIDRs) == 0 {
+				// otherwise any client could claim any address
+				return fmt.Errorf("group %v: proxyProtocolTrustedCIDRs is required by acceptProxyProtocol %v", g.Name, g.AcceptProxyProtocol)
+			}
+		default:
+			return fmt.Errorf("group %v: unknown acceptProxyProtocol: %v", g.Name, g.AcceptProxyProtocol)
+		}
+		for _, cidr := range g.ProxyProtocolTrustedCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("group %v: %w", g.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) CheckAuthFailPolicy() error {
+	for _, g := range config.Groups {
+		switch g.AuthFailPolicy {
+		case "", AuthFailFallback, AuthFailDrain, AuthFailRST, AuthFailDelay:
+		case AuthFailHold:
+			if g.AuthTimeoutSec <= 0 {
+				return fmt.Errorf("group %v: authTimeoutSec is required by authFailPolicy %v", g.Name, g.AuthFailPolicy)
+			}
+		default:
+			return fmt.Errorf("group %v: unknown authFailPolicy: %v", g.Name, g.AuthFailPolicy)
+		}
+	}
+	return nil
+}
+
+func (config *Config) CheckRateLimits() error {
+	for _, g := range config.Groups {
+		if g.UploadRateLimit < 0 || g.DownloadRateLimit < 0 || g.ClientUploadRateLimit < 0 || g.ClientDownloadRateLimit < 0 {
+			return fmt.Errorf("group %v: rate limits should not be negative", g.Name)
+		}
+		for _, s := range g.Servers {
+			if s.UploadRateLimit < 0 || s.DownloadRateLimit < 0 {
+				return fmt.Errorf("server %v: rate limits should not be negative", s.Name)
+			}
+			if s.DailyQuota < 0 || s.MonthlyQuota < 0 || s.TotalQuota < 0 {
+				return fmt.Errorf("server %v: quotas should not be negative", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func (config *Config) CheckDiverseCombinations() error {
 	groups := config.Groups
 	type methodPasswd struct {
@@ -156,11 +683,15 @@ func parseUpstreams(config *Config) (err error) {
 			go func(group *Group, upstreamConf *UpstreamConf) {
 				defer wg.Done()
 				servers, err := pullFromUpstream(upstreamConf, config.HttpClient)
+				upstreamConf.PullingTime = time.Now()
+				metrics.UpstreamPullTimestamp.With(group.Name, upstreamConf.Name).Set(float64(upstreamConf.PullingTime.Unix()))
 				if err != nil {
+					metrics.UpstreamPullSuccess.With(group.Name, upstreamConf.Name).Set(0)
 					upstreamConf.PullingError = err
 					log.Printf("[warning] Failed to pull from group %s upstream %s: %v\n", group.Name, upstreamConf.Name, err)
 					return
 				}
+				metrics.UpstreamPullSuccess.With(group.Name, upstreamConf.Name).Set(1)
 				mu.Lock()
 				group.Servers = append(group.Servers, servers...)
 				mu.Unlock()
@@ -174,9 +705,42 @@ func parseUpstreams(config *Config) (err error) {
 }
 
 func check(config *Config) (err error) {
+	if err = config.CheckListen(); err != nil {
+		return
+	}
 	if err = config.CheckMethodSupported(); err != nil {
 		return
 	}
+	if err = config.CheckKeys(); err != nil {
+		return
+	}
+	if err = config.CheckIdentityPSK(); err != nil {
+		return
+	}
+	if err = config.CheckProxyProtocol(); err != nil {
+		return
+	}
+	if err = config.CheckAuthFailPolicy(); err != nil {
+		return
+	}
+	if err = config.CheckRateLimits(); err != nil {
+		return
+	}
+	if err = config.CheckFallback(); err != nil {
+		return
+	}
+	if err = config.CheckOutbound(); err != nil {
+		return
+	}
+	if err = config.CheckTargets(); err != nil {
+		return
+	}
+	if err = config.CheckHealthCheck(); err != nil {
+		return
+	}
+	if err = config.CheckResolver(); err != nil {
+		return
+	}
 	if err = config.CheckDiverseCombinations(); err != nil {
 		return
 	}
@@ -188,6 +752,15 @@ func build(config *Config) {
 		g := &config.Groups[i]
 		g.BuildUserContextPool(LRUTimeout)
 		g.BuildMasterKeys()
+		g.BuildIdentities()
+		g.BuildTCPHeaderLen()
+		g.BuildReplayFilter()
+		g.BuildTrustedProxies()
+		g.BuildDisabledServers()
+		g.BuildFallback()
+		g.BuildLimiter()
+		g.BuildShaper()
+		g.BuildTargets()
 	}
 }
 
@@ -208,17 +781,26 @@ func BuildConfig(confPath string, c *http.Client) (conf *Config, err error) {
 	if err = check(conf); err != nil {
 		return nil, err
 	}
+	if conf.QuotaFile != "" {
+		if err = Quota().Open(conf.QuotaFile); err != nil {
+			return nil, err
+		}
+	}
+	Resolver().SetOptions(conf.Resolver.options())
 	build(conf)
 	return
 }
 
 func SetConfig(conf *Config) {
-	config = conf
+	config.Store(conf)
 }
 
-func NewConfig(c *http.Client) *Config {
-	var err error
+func GetConfig() *Config {
+	conf, _ := config.Load().(*Config)
+	return conf
+}
 
+func NewConfig(c *http.Client) *Config {
 	version := flag.Bool("v", false, "version")
 	confPath := flag.String("conf", "example.json", "config file path")
 	suppressTimestamps := flag.Bool("suppress-timestamps", false, "do not include timestamps in log")
@@ -233,8 +815,10 @@ func NewConfig(c *http.Client) *Config {
 		log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 	}
 
-	if config, err = BuildConfig(*confPath, c); err != nil {
+	conf, err := BuildConfig(*confPath, c)
+	if err != nil {
 		log.Fatalln(err)
 	}
-	return config
+	SetConfig(conf)
+	return conf
 }
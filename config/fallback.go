@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Qv2ray/mmp-go/infra/proxyproto"
+)
+
+const (
+	UDPFallbackDrop    = "drop"
+	UDPFallbackForward = "forward"
+
+	// FallbackServerName is the server name of the decoy target in logs and metrics.
+	FallbackServerName = "fallback"
+)
+
+type FallbackConf struct {
+	// Target is the decoy address where unauthenticated TCP connections are relayed to, e.g. a local web server.
+	// The bytes read during auth are relayed as well.
+	Target string `json:"target"`
+
+	// ProxyProtocol sends a PROXY protocol header carrying the client address to the targets: "v1", "v2" or "none".
+	// Default: none
+	// UDP packets always carry v2 headers because v1 does not support UDP.
+	ProxyProtocol string `json:"proxyProtocol"`
+
+	// UDP is the policy for unauthenticated UDP packets: "drop" or "forward".
+	// Default: drop
+	UDP string `json:"udp"`
+
+	// UDPTarget is where unauthenticated UDP packets are forwarded to if UDP is "forward".
+	// Default: same as Target
+	UDPTarget string `json:"udpTarget"`
+
+	tcpServer *Server
+	udpServer *Server
+}
+
+func (f *FallbackConf) newServer(target string) *Server {
+	proxyProtocol := f.ProxyProtocol
+	if proxyProtocol == "" {
+		// do not follow the group
+		proxyProtocol = "none"
+	}
+	return &Server{
+		Name:          FallbackServerName,
+		Target:        target,
+		ProxyProtocol: proxyProtocol,
+	}
+}
+
+func (g *Group) BuildFallback() {
+	f := g.Fallback
+	if f == nil {
+		return
+	}
+	f.tcpServer, f.udpServer = nil, nil
+	if f.Target != "" {
+		f.tcpServer = f.newServer(f.Target)
+	}
+	if f.UDP == UDPFallbackForward {
+		target := f.UDPTarget
+		if target == "" {
+			target = f.Target
+		}
+		f.udpServer = f.newServer(target)
+	}
+}
+
+// FallbackServer returns the server to relay unauthenticated TCP connections to, or nil if there is none.
+// It is the decoy target if configured, otherwise the first enabled server with a healthy target,
+// or the first enabled server if none of them is healthy.
+func (g *Group) FallbackServer() *Server {
+	if g.Fallback != nil && g.Fallback.tcpServer != nil {
+		return g.Fallback.tcpServer
+	}
+	var available *Server
+	for i := range g.Servers {
+		s := &g.Servers[i]
+		if !s.Available() {
+			continue
+		}
+		if s.Healthy() {
+			return s
+		}
+		if available == nil {
+			available = s
+		}
+	}
+	return available
+}
+
+// UDPFallbackServer returns the server to forward unauthenticated UDP packets to, or nil if they should be dropped.
+func (g *Group) UDPFallbackServer() *Server {
+	if g.Fallback == nil {
+		return nil
+	}
+	return g.Fallback.udpServer
+}
+
+func (config *Config) CheckFallback() error {
+	for _, g := range config.Groups {
+		f := g.Fallback
+		if f == nil {
+			continue
+		}
+		if _, err := proxyproto.ParseVersion(f.ProxyProtocol); err != nil {
+			return fmt.Errorf("fallback of group %v: %w", g.Name, err)
+		}
+		switch f.UDP {
+		case "", UDPFallbackDrop:
+		case UDPFallbackForward:
+			if f.UDPTarget == "" && f.Target == "" {
+				return fmt.Errorf("fallback of group %v: udpTarget is required to forward UDP packets", g.Name)
+			}
+		default:
+			return fmt.Errorf("fallback of group %v: unknown udp policy: %v", g.Name, f.UDP)
+		}
+		for _, target := range []string{f.Target, f.UDPTarget} {
+			if target == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return fmt.Errorf("fallback of group %v: %w", g.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/metrics"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 3 * time.Second
+	DefaultHealthCheckFails    = 3
+	DefaultHealthCheckRises    = 2
+)
+
+// HealthCheckConf checks the targets of servers in the group by connecting to them over TCP in the background.
+// Unhealthy targets are tried after the healthy ones.
+type HealthCheckConf struct {
+	// IntervalSec is the interval between checks of a target.
+	// Default: 10
+	IntervalSec int `json:"intervalSec"`
+
+	// TimeoutSec is the connect timeout of a check.
+	// Default: 3
+	TimeoutSec int `json:"timeoutSec"`
+
+	// FailThreshold is the number of consecutive failed checks to mark a healthy target unhealthy.
+	// Default: 3
+	FailThreshold int `json:"failThreshold"`
+
+	// RiseThreshold is the number of consecutive successful checks to mark an unhealthy target healthy.
+	// Default: 2
+	RiseThreshold int `json:"riseThreshold"`
+}
+
+func (hc HealthCheckConf) interval() time.Duration {
+	if hc.IntervalSec > 0 {
+		return time.Duration(hc.IntervalSec) * time.Second
+	}
+	return DefaultHealthCheckInterval
+}
+
+func (hc HealthCheckConf) timeout() time.Duration {
+	if hc.TimeoutSec > 0 {
+		return time.Duration(hc.TimeoutSec) * time.Second
+	}
+	return DefaultHealthCheckTimeout
+}
+
+func (hc HealthCheckConf) fails() int {
+	if hc.FailThreshold > 0 {
+		return hc.FailThreshold
+	}
+	return DefaultHealthCheckFails
+}
+
+func (hc HealthCheckConf) rises() int {
+	if hc.RiseThreshold > 0 {
+		return hc.RiseThreshold
+	}
+	return DefaultHealthCheckRises
+}
+
+// Healthy reports whether the target passes health checks. Targets are healthy if not checked.
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+func (t *Target) setHealthy(group string, healthy bool, err error) {
+	v := int32(1)
+	if healthy {
+		v = 0
+	}
+	if atomic.SwapInt32(&t.unhealthy, v) != v {
+		if healthy {
+			log.Printf("[health] target %v of group %v is up\n", t.Addr, group)
+		} else {
+			log.Printf("[health] target %v of group %v is down: %v\n", t.Addr, group, err)
+		}
+	}
+	if healthy {
+		metrics.TargetHealthy.With(group, t.Addr).Set(1)
+	} else {
+		metrics.TargetHealthy.With(group, t.Addr).Set(0)
+	}
+}
+
+// Healthy reports whether any target of the server is healthy.
+func (s *Server) Healthy() bool {
+	if len(s.targets) == 0 {
+		return true
+	}
+	for _, t := range s.targets {
+		if t.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts checking the health of the targets if the group enables it.
+func (set *TargetSet) Start() {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.running = true
+	set.startCheckers()
+}
+
+// Stop stops checking the health of the targets.
+func (set *TargetSet) Stop() {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.running = false
+	set.stopCheckers()
+}
+
+// startCheckers starts a checker for each target without one. set.mu must be held.
+func (set *TargetSet) startCheckers() {
+	if set.healthCheck == nil {
+		return
+	}
+	for _, t := range set.targets {
+		if t.stop == nil {
+			t.stop = make(chan struct{})
+			go set.check(t, t.stop)
+		}
+	}
+}
+
+// stopCheckers stops all checkers and marks the targets healthy. set.mu must be held.
+func (set *TargetSet) stopCheckers() {
+	for _, t := range set.targets {
+		if t.stop != nil {
+			close(t.stop)
+			t.stop = nil
+		}
+		atomic.StoreInt32(&t.unhealthy, 0)
+	}
+}
+
+func (set *TargetSet) check(t *Target, stop chan struct{}) {
+	var fails, rises int
+	for {
+		set.mu.Lock()
+		hc, dialer, group, preference := set.healthCheck, set.dialer, set.group, set.preference
+		set.mu.Unlock()
+		if hc == nil {
+			return
+		}
+		dialer.Timeout = hc.timeout()
+		c, err := Resolver().Dial(context.Background(), "tcp", t.Addr, preference, dialer.DialContext)
+		select {
+		case <-stop:
+			// the result is stale
+			if err == nil {
+				c.Close()
+			}
+			return
+		default:
+		}
+		if err == nil {
+			c.Close()
+			fails, rises = 0, rises+1
+			if t.Healthy() || rises >= hc.rises() {
+				t.setHealthy(group, true, nil)
+			}
+		} else {
+			fails, rises = fails+1, 0
+			if !t.Healthy() || fails >= hc.fails() {
+				t.setHealthy(group, false, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(hc.interval()):
+		}
+	}
+}
+
+// StartHealthChecks starts checking the targets of the groups, and stops the checks of the old groups not taken over.
+func (config *Config) StartHealthChecks(old *Config) {
+	sets := make(map[*TargetSet]struct{})
+	for i := range config.Groups {
+		if set := config.Groups[i].TargetSet; set != nil {
+			set.Start()
+			sets[set] = struct{}{}
+		}
+	}
+	if old == nil {
+		return
+	}
+	for i := range old.Groups {
+		if set := old.Groups[i].TargetSet; set != nil {
+			if _, ok := sets[set]; !ok {
+				set.Stop()
+			}
+		}
+	}
+}
+
+func (config *Config) CheckHealthCheck() error {
+	for _, g := range config.Groups {
+		hc := g.HealthCheck
+		if hc == nil {
+			continue
+		}
+		if hc.IntervalSec < 0 || hc.TimeoutSec < 0 || hc.FailThreshold < 0 || hc.RiseThreshold < 0 {
+			return fmt.Errorf("healthCheck of group %v: values should not be negative", g.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTargetSet_HealthCheck(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+
+	g := &Group{
+		Name:        "health",
+		HealthCheck: &HealthCheckConf{IntervalSec: 1, FailThreshold: 1, RiseThreshold: 1},
+		Servers: []Server{
+			{Name: "a", Target: downAddr},
+			{Name: "b", Target: downAddr, Targets: []string{up.Addr().String()}},
+		},
+	}
+	g.BuildTargets()
+	conf := &Config{Groups: []Group{*g}}
+	g = &conf.Groups[0]
+	conf.StartHealthChecks(nil)
+	defer g.TargetSet.Stop()
+
+	waitHealthy := func(target *Target, healthy bool) {
+		for i := 0; i < 50 && target.Healthy() != healthy; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if target.Healthy() != healthy {
+			t.Fatalf("expect %v healthy: %v", target.Addr, healthy)
+		}
+	}
+
+	down.Close()
+	target := g.Servers[0].TargetList()[0]
+	waitHealthy(target, false)
+	if s := g.FallbackServer(); s != &g.Servers[1] {
+		t.Fatalf("fallback should skip the server without healthy targets, got %v", s.Name)
+	}
+	if targets := g.Servers[1].PickTargets(nil); targets[0].Addr != up.Addr().String() {
+		t.Fatalf("unhealthy targets should be tried last, got %v first", targets[0].Addr)
+	}
+
+	// recover
+	down, err = net.Listen("tcp", downAddr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer down.Close()
+	waitHealthy(target, true)
+	if s := g.FallbackServer(); s != &g.Servers[0] {
+		t.Fatalf("fallback should be the first server after recovering, got %v", s.Name)
+	}
+
+	// disabling the check marks the targets healthy
+	down.Close()
+	waitHealthy(target, false)
+	g.HealthCheck = nil
+	g.InheritTargets(g)
+	if !target.Healthy() {
+		t.Fatal("targets should be healthy without checks")
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	LimitGroup = "group"
+	LimitIP    = "ip"
+	LimitRate  = "rate"
+
+	limiterSweepInterval = time.Minute
+)
+
+// Limits are the caps enforced by a Limiter. Zero means unlimited.
+type Limits struct {
+	MaxConns         int
+	MaxTCPConnsPerIP int
+	MaxSessionsPerIP int
+	NewConnRate      float64
+	NewConnBurst     int
+}
+
+// Limiter caps the TCP connections and UDP sessions of a group in total and per client IP.
+type Limiter struct {
+	mu        sync.Mutex
+	limits    Limits
+	total     int
+	ips       map[string]*ipUsage
+	lastSweep time.Time
+}
+
+type ipUsage struct {
+	tcp    int
+	udp    int
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{ips: make(map[string]*ipUsage), lastSweep: time.Now()}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits updates the limits. Existing connections are not affected.
+func (l *Limiter) SetLimits(limits Limits) {
+	if limits.NewConnRate > 0 && limits.NewConnBurst <= 0 {
+		limits.NewConnBurst = int(math.Max(1, math.Ceil(limits.NewConnRate)))
+	}
+	l.mu.Lock()
+	l.limits = limits
+	l.mu.Unlock()
+}
+
+// Acquire takes a slot for a new TCP connection or UDP session from the ip.
+// It returns the limit which rejects it, or a function to release the slot when it ends.
+func (l *Limiter) Acquire(ip net.IP, protocol string) (release func(), rejectedBy string) {
+	now := time.Now()
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	if l.limits.MaxConns > 0 && l.total >= l.limits.MaxConns {
+		return nil, LimitGroup
+	}
+	u, ok := l.ips[key]
+	if !ok {
+		u = &ipUsage{tokens: float64(l.limits.NewConnBurst), last: now}
+	}
+	count, max := &u.tcp, l.limits.MaxTCPConnsPerIP
+	if protocol == "udp" {
+		count, max = &u.udp, l.limits.MaxSessionsPerIP
+	}
+	if max > 0 && *count >= max {
+		return nil, LimitIP
+	}
+	if l.limits.NewConnRate > 0 {
+		u.refill(now, l.limits)
+		if u.tokens < 1 {
+			l.ips[key] = u
+			return nil, LimitRate
+		}
+		u.tokens--
+	}
+	*count++
+	l.total++
+	l.ips[key] = u
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			*count--
+			l.total--
+			if u.tcp == 0 && u.udp == 0 && l.limits.NewConnRate <= 0 {
+				delete(l.ips, key)
+			}
+		})
+	}, ""
+}
+
+func (u *ipUsage) refill(now time.Time, limits Limits) {
+	u.tokens = math.Min(float64(limits.NewConnBurst), u.tokens+now.Sub(u.last).Seconds()*limits.NewConnRate)
+	u.last = now
+}
+
+// sweep forgets IPs without connections and with full buckets.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, u := range l.ips {
+		if u.tcp != 0 || u.udp != 0 {
+			continue
+		}
+		if l.limits.NewConnRate > 0 {
+			u.refill(now, l.limits)
+			if u.tokens < float64(l.limits.NewConnBurst) {
+				continue
+			}
+		}
+		delete(l.ips, key)
+	}
+}
+
+// Total returns the number of TCP connections and UDP sessions holding slots.
+func (l *Limiter) Total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	l := NewLimiter(Limits{MaxConns: 3, MaxTCPConnsPerIP: 2, MaxSessionsPerIP: 1})
+
+	r1, _ := l.Acquire(a, "tcp")
+	r2, _ := l.Acquire(a, "tcp")
+	if r1 == nil || r2 == nil {
+		t.Fatal("failed to acquire slots under the limits")
+	}
+	if _, limit := l.Acquire(a, "tcp"); limit != LimitIP {
+		t.Fatalf("expect rejected by %v, got %q", LimitIP, limit)
+	}
+	// TCP and UDP are limited separately per IP
+	r3, _ := l.Acquire(a, "udp")
+	if r3 == nil {
+		t.Fatal("failed to acquire a UDP slot")
+	}
+	if _, limit := l.Acquire(b, "tcp"); limit != LimitGroup {
+		t.Fatalf("expect rejected by %v, got %q", LimitGroup, limit)
+	}
+	r1()
+	r1()
+	if l.Total() != 2 {
+		t.Fatalf("expect 2 slots in use, got %v", l.Total())
+	}
+	if r, _ := l.Acquire(b, "tcp"); r == nil {
+		t.Fatal("failed to acquire a released slot")
+	}
+
+	// raising the limits takes effect immediately
+	l.SetLimits(Limits{MaxTCPConnsPerIP: 3})
+	if r, _ := l.Acquire(a, "tcp"); r == nil {
+		t.Fatal("failed to acquire a slot under the new limits")
+	}
+	r2()
+	r3()
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	l := NewLimiter(Limits{NewConnRate: 20, NewConnBurst: 2})
+	for i := 0; i < 2; i++ {
+		if r, _ := l.Acquire(ip, "tcp"); r == nil {
+			t.Fatal("failed to acquire a slot in the burst")
+		}
+	}
+	if _, limit := l.Acquire(ip, "udp"); limit != LimitRate {
+		t.Fatalf("expect rejected by %v, got %q", LimitRate, limit)
+	}
+	if r, _ := l.Acquire(net.ParseIP("2001:db8::2"), "tcp"); r == nil {
+		t.Fatal("other IPs should not be limited")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if r, _ := l.Acquire(ip, "tcp"); r == nil {
+		t.Fatal("tokens should be refilled")
+	}
+}
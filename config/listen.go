@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Qv2ray/mmp-go/infra/activation"
+)
+
+// MaxPorts caps the ports of a group, as each of them takes a TCP and a UDP socket on every address.
+const MaxPorts = 1024
+
+// ListenAddr is an address for dispatchers to listen on.
+type ListenAddr struct {
+	// IP is nil to listen on all interfaces of both IPv4 and IPv6.
+	IP   net.IP
+	Port int
+}
+
+func (a ListenAddr) String() string {
+	if a.IP == nil {
+		return ":" + strconv.Itoa(a.Port)
+	}
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// Network returns the network of protocol to listen on a, e.g. "tcp4" for IPv4 addresses.
+// Listening on "::" by "tcp6" or "udp6" accepts IPv6 only.
+func (a ListenAddr) Network(protocol string) string {
+	switch {
+	case a.IP == nil:
+		return protocol
+	case a.IP.To4() != nil:
+		return protocol + "4"
+	default:
+		return protocol + "6"
+	}
+}
+
+// Overlaps reports whether a and b cannot be listened on at the same time.
+func (a ListenAddr) Overlaps(b ListenAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+	if a.IP == nil || b.IP == nil || a.IP.Equal(b.IP) {
+		return true
+	}
+	sameFamily := (a.IP.To4() != nil) == (b.IP.To4() != nil)
+	return sameFamily && (a.IP.IsUnspecified() || b.IP.IsUnspecified())
+}
+
+// parseListenAddr parses "ip", "ip:port" or "[ipv6]:port". The port is 0 if omitted.
+func parseListenAddr(s string) (addr ListenAddr, err error) {
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host = h
+		if addr.Port, err = strconv.Atoi(p); err != nil || !validPort(addr.Port) {
+			return addr, fmt.Errorf("invalid port: %v", s)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host != "" {
+		if addr.IP = net.ParseIP(host); addr.IP == nil {
+			return addr, fmt.Errorf("invalid IP: %v", s)
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+	}
+	return addr, nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// parsePorts parses ports and port ranges like "20000-20100".
+func parsePorts(ports []string) ([]int, error) {
+	var result []int
+	for _, s := range ports {
+		fields := strings.SplitN(s, "-", 2)
+		start, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || !validPort(start) {
+			return nil, fmt.Errorf("invalid port: %v", s)
+		}
+		end := start
+		if len(fields) == 2 {
+			if end, err = strconv.Atoi(strings.TrimSpace(fields[1])); err != nil || !validPort(end) || end < start {
+				return nil, fmt.Errorf("invalid port range: %v", s)
+			}
+		}
+		for port := start; port <= end; port++ {
+			result = append(result, port)
+		}
+	}
+	return result, nil
+}
+
+// ListenPorts returns Port and Ports of the group without duplicates.
+func (g *Group) ListenPorts() []int {
+	ports, _ := g.listenPorts()
+	return ports
+}
+
+func (g *Group) listenPorts() ([]int, error) {
+	ports, err := parsePorts(g.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if g.Port != 0 {
+		ports = append([]int{g.Port}, ports...)
+	}
+	seen := make(map[int]struct{}, len(ports))
+	result := ports[:0]
+	for _, port := range ports {
+		if _, ok := seen[port]; !ok {
+			seen[port] = struct{}{}
+			result = append(result, port)
+		}
+	}
+	if len(result) > MaxPorts {
+		return nil, fmt.Errorf("too many ports: %d, at most %d ports per group", len(result), MaxPorts)
+	}
+	return result, nil
+}
+
+// ListenAddrs returns the addresses the group listens on.
+func (g *Group) ListenAddrs() []ListenAddr {
+	addrs, _ := g.listenAddrs()
+	return addrs
+}
+
+func (g *Group) listenAddrs() ([]ListenAddr, error) {
+	ports, err := g.listenPorts()
+	if err != nil {
+		return nil, err
+	}
+	listen := g.Listen
+	if len(listen) == 0 {
+		if len(ports) == 0 {
+			// listen on the sockets named after the group
+			if addrs := activatedAddrs(g.Name); len(addrs) > 0 {
+				return addrs, nil
+			}
+		}
+		listen = []string{""}
+	}
+	var addrs []ListenAddr
+	for _, s := range listen {
+		addr, err := parseListenAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		if addr.Port != 0 {
+			addrs = append(addrs, addr)
+			continue
+		}
+		if len(ports) == 0 {
+			return nil, fmt.Errorf("no port to listen on %v", s)
+		}
+		for _, port := range ports {
+			addrs = append(addrs, ListenAddr{IP: addr.IP, Port: port})
+		}
+	}
+	return addrs, nil
+}
+
+// activatedAddrs returns the addresses of the sockets passed by systemd with the name.
+func activatedAddrs(name string) (addrs []ListenAddr) {
+	seen := make(map[string]struct{})
+	for _, s := range activation.Named(name) {
+		var addr ListenAddr
+		switch a := s.Addr().(type) {
+		case *net.TCPAddr:
+			addr = ListenAddr{IP: a.IP, Port: a.Port}
+		case *net.UDPAddr:
+			addr = ListenAddr{IP: a.IP, Port: a.Port}
+		default:
+			continue
+		}
+		if addr.IP.IsUnspecified() {
+			// systemd binds both IPv4 and IPv6 by default
+			addr.IP = nil
+		} else if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+		if _, ok := seen[addr.String()]; !ok {
+			seen[addr.String()] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// MatchSocket returns whether a socket passed by systemd can be used by the group to listen on addr.
+// Sockets named after a group are used by the group only.
+func (g *Group) MatchSocket(network string, addr ListenAddr) func(s *activation.Socket) bool {
+	return func(s *activation.Socket) bool {
+		if !s.Match(network, addr.IP, addr.Port) {
+			return false
+		}
+		if s.Name == g.Name {
+			return true
+		}
+		if c := GetConfig(); c != nil {
+			for i := range c.Groups {
+				if c.Groups[i].Name == s.Name {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+// Shards returns the number of sockets per address and protocol.
+func (g *Group) Shards() int {
+	if g.ListenerShards <= 0 {
+		return 1
+	}
+	return g.ListenerShards
+}
+
+// FindGroup returns the group in groups listening on any of the addresses of g, or nil if none.
+func (g *Group) FindGroup(groups []Group) *Group {
+	addrs := make(map[string]struct{})
+	for _, a := range g.ListenAddrs() {
+		addrs[a.String()] = struct{}{}
+	}
+	for i := range groups {
+		for _, b := range groups[i].ListenAddrs() {
+			if _, ok := addrs[b.String()]; ok {
+				return &groups[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) CheckListen() error {
+	type owned struct {
+		ListenAddr
+		group string
+	}
+	byPort := make(map[int][]owned)
+	for i := range config.Groups {
+		g := &config.Groups[i]
+		if g.ListenerShards < 0 {
+			return fmt.Errorf("group %v: listenerShards should not be negative", g.Name)
+		}
+		addrs, err := g.listenAddrs()
+		if err != nil {
+			return fmt.Errorf("group %v: %w", g.Name, err)
+		}
+		for _, a := range addrs {
+			for _, b := range byPort[a.Port] {
+				if a.Overlaps(b.ListenAddr) {
+					return fmt.Errorf("group %v: %v overlaps %v of group %v", g.Name, a, b.ListenAddr, b.group)
+				}
+			}
+			byPort[a.Port] = append(byPort[a.Port], owned{a, g.Name})
+		}
+	}
+	return nil
+}
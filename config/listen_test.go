@@ -0,0 +1,123 @@
+package config
+
+import "testing"
+
+func TestGroup_ListenAddrs(t *testing.T) {
+	g := &Group{Port: 1090, Listen: []string{"192.0.2.1", "[2001:db8::1]:8388", "::", "0.0.0.0:1091"}}
+	addrs, err := g.listenAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		addr    string
+		network string
+	}{
+		{"192.0.2.1:1090", "tcp4"},
+		{"[2001:db8::1]:8388", "tcp6"},
+		{"[::]:1090", "tcp6"},
+		{"0.0.0.0:1091", "tcp4"},
+	}
+	for i, e := range expected {
+		if addrs[i].String() != e.addr || addrs[i].Network("tcp") != e.network {
+			t.Fatalf("expect %v %v, got %v %v", e.network, e.addr, addrs[i].Network("tcp"), addrs[i])
+		}
+	}
+
+	g = &Group{Port: 1090}
+	if addrs := g.ListenAddrs(); len(addrs) != 1 || addrs[0].String() != ":1090" || addrs[0].Network("udp") != "udp" {
+		t.Fatalf("unexpected default addresses: %v", addrs)
+	}
+
+	for _, listen := range []string{"example.com", "192.0.2.1:http", "192.0.2.1:70000"} {
+		if _, err := (&Group{Port: 1090, Listen: []string{listen}}).listenAddrs(); err == nil {
+			t.Fatalf("expect an error for %v", listen)
+		}
+	}
+}
+
+func TestConfig_CheckListen(t *testing.T) {
+	cases := []struct {
+		a, b    []string
+		overlap bool
+	}{
+		{[]string{"192.0.2.1"}, []string{"192.0.2.2"}, false},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.1"}, true},
+		{[]string{"192.0.2.1"}, []string{"0.0.0.0"}, true},
+		{[]string{"192.0.2.1"}, nil, true},
+		{[]string{"0.0.0.0"}, []string{"::"}, false},
+		{[]string{"::1"}, []string{"::"}, true},
+		{[]string{"192.0.2.1:1091"}, []string{"192.0.2.1"}, false},
+	}
+	for _, c := range cases {
+		conf := &Config{Groups: []Group{
+			{Name: "a", Port: 1090, Listen: c.a},
+			{Name: "b", Port: 1090, Listen: c.b},
+		}}
+		if err := conf.CheckListen(); (err != nil) != c.overlap {
+			t.Fatalf("%v and %v: expect overlapping %v, got %v", c.a, c.b, c.overlap, err)
+		}
+	}
+}
+
+func TestGroup_FindGroup(t *testing.T) {
+	old := []Group{
+		{Name: "a", Port: 1090, Listen: []string{"192.0.2.1"}},
+		{Name: "b", Port: 1090, Listen: []string{"192.0.2.2", "192.0.2.3"}},
+	}
+	g := &Group{Name: "c", Port: 1090, Listen: []string{"192.0.2.3", "192.0.2.4"}}
+	if found := g.FindGroup(old); found == nil || found.Name != "b" {
+		t.Fatalf("unexpected group: %v", found)
+	}
+	g.Listen = []string{"192.0.2.4"}
+	if found := g.FindGroup(old); found != nil {
+		t.Fatalf("unexpected group: %v", found.Name)
+	}
+}
+
+func TestGroup_ListenPorts(t *testing.T) {
+	g := &Group{Port: 20001, Ports: []string{"20000-20003", "20010", " 20020 - 20021 "}, Listen: []string{"192.0.2.1", "192.0.2.2:1090"}}
+	addrs, err := g.listenAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range addrs {
+		got = append(got, a.String())
+	}
+	expected := []string{
+		"192.0.2.1:20001", "192.0.2.1:20000", "192.0.2.1:20002", "192.0.2.1:20003",
+		"192.0.2.1:20010", "192.0.2.1:20020", "192.0.2.1:20021", "192.0.2.2:1090",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expect %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expect %v, got %v", expected, got)
+		}
+	}
+
+	for _, ports := range []string{"20003-20000", "0-10", "20000-70000", "a-b", "10000-20000"} {
+		if _, err := (&Group{Ports: []string{ports}}).listenAddrs(); err == nil {
+			t.Fatalf("expect an error for %v", ports)
+		}
+	}
+	// the port counts, while overlapping ranges do not
+	if _, err := (&Group{Port: 10000, Ports: []string{"20000-21023"}}).listenAddrs(); err == nil {
+		t.Fatal("expect an error for more than MaxPorts ports")
+	}
+	if ports, err := (&Group{Port: 20000, Ports: []string{"20000-21023", "20500-20600"}}).listenPorts(); err != nil || len(ports) != MaxPorts {
+		t.Fatalf("expect %v ports, got %v %v", MaxPorts, len(ports), err)
+	}
+	if _, err := (&Group{Listen: []string{"192.0.2.1"}}).listenAddrs(); err == nil {
+		t.Fatal("expect an error without ports")
+	}
+
+	conf := &Config{Groups: []Group{
+		{Name: "a", Ports: []string{"20000-20100"}},
+		{Name: "b", Ports: []string{"20100-20200"}},
+	}}
+	if err := conf.CheckListen(); err == nil {
+		t.Fatal("expect overlapping ranges")
+	}
+}
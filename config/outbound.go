@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/infra/resolver"
+	"github.com/Qv2ray/mmp-go/infra/sockopt"
+)
+
+// OutboundConf sets the socket options of connections to the targets, e.g. to steer them through policy routing or a specific uplink.
+// Options set by a server override the ones set by its group.
+type OutboundConf struct {
+	// SourceAddress is the local IP to dial from.
+	// Default: chosen by the system
+	// Targets of the other IP family fail to dial.
+	SourceAddress string `json:"sourceAddress"`
+
+	// Interface binds the sockets to a network interface by SO_BINDTODEVICE, e.g. "eth1". Linux only.
+	// Default: not bound
+	Interface string `json:"interface"`
+
+	// Mark sets the fwmark of the sockets by SO_MARK for policy routing. Linux only.
+	// Default: not marked
+	Mark int `json:"mark"`
+
+	// DSCP sets the DSCP bits of the TOS or traffic class field, from 0 to 63, e.g. 46 for expedited forwarding. Linux only.
+	// Default: 0
+	DSCP int `json:"dscp"`
+
+	// TCPKeepAliveSec is the interval of TCP keep-alive probes.
+	// Default: 15
+	// Set to a negative value to disable keep-alive.
+	TCPKeepAliveSec int `json:"tcpKeepAliveSec"`
+
+	// TCPUserTimeoutSec closes TCP connections with data unacknowledged for the duration by TCP_USER_TIMEOUT. Linux only.
+	// Default: decided by the system
+	TCPUserTimeoutSec int `json:"tcpUserTimeoutSec"`
+
+	// TCPNoDelay sets TCP_NODELAY to send small segments without delay.
+	// Default: true
+	TCPNoDelay *bool `json:"tcpNoDelay"`
+
+	// IPPreference decides the IP family of targets with host names: "prefer-ipv4", "prefer-ipv6", "ipv4-only" or "ipv6-only".
+	// Default: in the order of the system resolver, or IPv6 first if resolver.address is set
+	// TCP dials the other IP family if the first one does not connect in 300ms (happy eyeballs).
+	IPPreference string `json:"ipPreference"`
+}
+
+// merge returns the options of o overridden by the ones set in that.
+func (o OutboundConf) merge(that *OutboundConf) OutboundConf {
+	if that == nil {
+		return o
+	}
+	if that.SourceAddress != "" {
+		o.SourceAddress = that.SourceAddress
+	}
+	if that.Interface != "" {
+		o.Interface = that.Interface
+	}
+	if that.Mark != 0 {
+		o.Mark = that.Mark
+	}
+	if that.DSCP != 0 {
+		o.DSCP = that.DSCP
+	}
+	if that.TCPKeepAliveSec != 0 {
+		o.TCPKeepAliveSec = that.TCPKeepAliveSec
+	}
+	if that.TCPUserTimeoutSec != 0 {
+		o.TCPUserTimeoutSec = that.TCPUserTimeoutSec
+	}
+	if that.TCPNoDelay != nil {
+		o.TCPNoDelay = that.TCPNoDelay
+	}
+	if that.IPPreference != "" {
+		o.IPPreference = that.IPPreference
+	}
+	return o
+}
+
+func (o OutboundConf) SockOpt() sockopt.Options {
+	return sockopt.Options{
+		Interface:   o.Interface,
+		Mark:        o.Mark,
+		TOS:         o.DSCP << 2,
+		UserTimeout: time.Duration(o.TCPUserTimeoutSec) * time.Second,
+	}
+}
+
+// NoDelay reports whether to set TCP_NODELAY.
+func (o OutboundConf) NoDelay() bool {
+	return o.TCPNoDelay == nil || *o.TCPNoDelay
+}
+
+func (o OutboundConf) check() error {
+	if o.SourceAddress != "" && net.ParseIP(o.SourceAddress) == nil {
+		return fmt.Errorf("invalid sourceAddress: %v", o.SourceAddress)
+	}
+	if o.Mark < 0 {
+		return fmt.Errorf("mark should not be negative")
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("dscp should be between 0 and 63")
+	}
+	if o.TCPUserTimeoutSec < 0 {
+		return fmt.Errorf("tcpUserTimeoutSec should not be negative")
+	}
+	if err := resolver.ParsePreference(o.IPPreference); err != nil {
+		return err
+	}
+	return o.SockOpt().Check()
+}
+
+// OutboundOf returns the outbound options of the server, which follow the group unless set by the server.
+func (g *Group) OutboundOf(s *Server) OutboundConf {
+	var o OutboundConf
+	o = o.merge(g.Outbound)
+	if s != nil {
+		o = o.merge(s.Outbound)
+	}
+	return o
+}
+
+// Dialer returns the dialer to the target of the server over network "tcp" or "udp".
+func (g *Group) Dialer(s *Server, network string) net.Dialer {
+	o := g.OutboundOf(s)
+	d := net.Dialer{
+		Timeout:   time.Duration(g.DialTimeoutSec) * time.Second,
+		KeepAlive: time.Duration(o.TCPKeepAliveSec) * time.Second,
+	}
+	if ip := net.ParseIP(o.SourceAddress); ip != nil {
+		switch network {
+		case "tcp":
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		case "udp":
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+	if opt := o.SockOpt(); !opt.Empty() {
+		d.Control = opt.Control
+	}
+	return d
+}
+
+// DialTarget dials the address by the dial function, resolving the host name by Resolver with the IP preference of the server.
+func (g *Group) DialTarget(s *Server, network, address string, dial resolver.DialFunc) (net.Conn, error) {
+	return Resolver().Dial(context.Background(), network, address, g.OutboundOf(s).IPPreference, dial)
+}
+
+func (config *Config) CheckOutbound() error {
+	for _, g := range config.Groups {
+		if g.Outbound != nil {
+			if err := g.Outbound.check(); err != nil {
+				return fmt.Errorf("outbound of group %v: %w", g.Name, err)
+			}
+		}
+		for _, s := range g.Servers {
+			if s.Outbound != nil {
+				if err := g.OutboundOf(&s).check(); err != nil {
+					return fmt.Errorf("outbound of server %v: %w", s.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
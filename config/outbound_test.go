@@ -0,0 +1,60 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGroup_OutboundOf(t *testing.T) {
+	noDelay := false
+	g := &Group{
+		Name:     "g",
+		Outbound: &OutboundConf{SourceAddress: "127.0.0.1", TCPKeepAliveSec: 30, TCPNoDelay: &noDelay},
+		Servers: []Server{
+			{Name: "a"},
+			{Name: "b", Outbound: &OutboundConf{TCPKeepAliveSec: -1}},
+		},
+	}
+	a, b := g.OutboundOf(&g.Servers[0]), g.OutboundOf(&g.Servers[1])
+	if a.TCPKeepAliveSec != 30 || b.TCPKeepAliveSec != -1 {
+		t.Fatalf("unexpected keep-alive: %v %v", a.TCPKeepAliveSec, b.TCPKeepAliveSec)
+	}
+	if b.SourceAddress != "127.0.0.1" || b.NoDelay() {
+		t.Fatalf("server b should follow the group: %+v", b)
+	}
+	if yes := true; !g.OutboundOf(&Server{Outbound: &OutboundConf{TCPNoDelay: &yes}}).NoDelay() {
+		t.Fatal("tcpNoDelay of the server should override the group")
+	}
+	if !(&Group{}).OutboundOf(nil).NoDelay() {
+		t.Fatal("tcpNoDelay should be enabled by default")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialer := g.Dialer(&g.Servers[0], "tcp")
+	c, err := dialer.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := c.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expect source address 127.0.0.1, got %v", ip)
+	}
+}
+
+func TestConfig_CheckOutbound(t *testing.T) {
+	for _, o := range []OutboundConf{
+		{SourceAddress: "localhost"},
+		{Mark: -1},
+		{DSCP: 64},
+		{TCPUserTimeoutSec: -1},
+	} {
+		conf := &Config{Groups: []Group{{Name: "g", Servers: []Server{{Name: "s", Outbound: &o}}}}}
+		if err := conf.CheckOutbound(); err == nil {
+			t.Fatalf("expect an error for %+v", o)
+		}
+	}
+}
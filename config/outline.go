@@ -30,6 +30,11 @@ type Outline struct {
 	ApiCertSha256         string `json:"apiCertSha256"`
 	TCPFastOpen           bool   `json:"TCPFastOpen"`
 	AccessKeyPortOverride int    `json:"accessKeyPortOverride"`
+	// DailyQuota, MonthlyQuota and TotalQuota apply to every access key.
+	// Default: unlimited
+	DailyQuota   int64 `json:"dailyQuota"`
+	MonthlyQuota int64 `json:"monthlyQuota"`
+	TotalQuota   int64 `json:"totalQuota"`
 }
 
 const timeout = 10 * time.Second
@@ -225,7 +230,13 @@ func (outline Outline) GetServers(c *http.Client) (servers []Server, err error)
 	if err != nil {
 		return
 	}
-	return conf.ToServers(outline.Name, outline.Server, outline.TCPFastOpen, outline.AccessKeyPortOverride), nil
+	servers = conf.ToServers(outline.Name, outline.Server, outline.TCPFastOpen, outline.AccessKeyPortOverride)
+	for i := range servers {
+		servers[i].DailyQuota = outline.DailyQuota
+		servers[i].MonthlyQuota = outline.MonthlyQuota
+		servers[i].TotalQuota = outline.TotalQuota
+	}
+	return servers, nil
 }
 
 func (outline Outline) Equal(that Upstream) bool {
@@ -250,6 +261,7 @@ func (key *AccessKey) ToServer(name, host string, tfo bool, portOverride int) Se
 		portOverride = key.Port
 	}
 	return Server{
+		ID:          fmt.Sprintf("outline/%s/%s", host, key.ID),
 		Name:        fmt.Sprintf("%s - %s", name, key.Name),
 		Target:      net.JoinHostPort(host, strconv.Itoa(portOverride)),
 		TCPFastOpen: tfo,
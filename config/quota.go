@@ -0,0 +1,324 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QuotaFlushInterval = time.Minute
+
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// QuotaUsage is the traffic of a server in both directions.
+type QuotaUsage struct {
+	Day        string `json:"day"`
+	DayBytes   uint64 `json:"dayBytes"`
+	Month      string `json:"month"`
+	MonthBytes uint64 `json:"monthBytes"`
+	TotalBytes uint64 `json:"totalBytes"`
+}
+
+// roll resets the counters of past periods.
+func (u *QuotaUsage) roll(now time.Time) {
+	if day := now.Format(dayLayout); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format(monthLayout); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// sub returns the bytes of u counted after base, in the periods of u.
+func (u QuotaUsage) sub(base QuotaUsage) QuotaUsage {
+	if base.Day == u.Day {
+		u.DayBytes = subBytes(u.DayBytes, base.DayBytes)
+	}
+	if base.Month == u.Month {
+		u.MonthBytes = subBytes(u.MonthBytes, base.MonthBytes)
+	}
+	u.TotalBytes = subBytes(u.TotalBytes, base.TotalBytes)
+	return u
+}
+
+func subBytes(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// quotaCounter counts the traffic of a server without locking.
+type quotaCounter struct {
+	dayBytes   uint64
+	monthBytes uint64
+	totalBytes uint64
+	// dayEnd is the unix nano time the day ends, cached to avoid formatting the time on every packet.
+	// Months end with days.
+	dayEnd int64
+
+	mu    sync.Mutex
+	day   string
+	month string
+
+	// flushed is the usage in the file as of the last flush, guarded by mu of QuotaStore.
+	flushed QuotaUsage
+}
+
+// roll resets the counters of past periods.
+func (c *quotaCounter) roll(now time.Time) {
+	if now.UnixNano() < atomic.LoadInt64(&c.dayEnd) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.UnixNano() < atomic.LoadInt64(&c.dayEnd) {
+		return
+	}
+	if day := now.Format(dayLayout); c.day != day {
+		c.day = day
+		atomic.StoreUint64(&c.dayBytes, 0)
+	}
+	if month := now.Format(monthLayout); c.month != month {
+		c.month = month
+		atomic.StoreUint64(&c.monthBytes, 0)
+	}
+	y, m, d := now.Date()
+	atomic.StoreInt64(&c.dayEnd, time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).UnixNano())
+}
+
+func (c *quotaCounter) add(u QuotaUsage, now time.Time) {
+	c.roll(now)
+	atomic.AddUint64(&c.dayBytes, u.DayBytes)
+	atomic.AddUint64(&c.monthBytes, u.MonthBytes)
+	atomic.AddUint64(&c.totalBytes, u.TotalBytes)
+}
+
+func (c *quotaCounter) usage(now time.Time) QuotaUsage {
+	c.roll(now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return QuotaUsage{
+		Day:        c.day,
+		DayBytes:   atomic.LoadUint64(&c.dayBytes),
+		Month:      c.month,
+		MonthBytes: atomic.LoadUint64(&c.monthBytes),
+		TotalBytes: atomic.LoadUint64(&c.totalBytes),
+	}
+}
+
+// QuotaStore counts the traffic of servers by their quota IDs, and saves the counters to a file if set.
+// Counting takes no lock, since it happens on every read and auth.
+// Saving merges the traffic counted since the last save into the file rather than overwriting it,
+// as the old and the new process both save during an upgrade.
+type QuotaStore struct {
+	mu       sync.Mutex
+	path     string
+	counters sync.Map // quota ID -> *quotaCounter
+	dirty    int32
+}
+
+var quotaStore = new(QuotaStore)
+
+// Quota returns the quota store of the process, which survives reloads.
+func Quota() *QuotaStore {
+	return quotaStore
+}
+
+func (s *QuotaStore) counter(id string) *quotaCounter {
+	if c, ok := s.counters.Load(id); ok {
+		return c.(*quotaCounter)
+	}
+	c, _ := s.counters.LoadOrStore(id, new(quotaCounter))
+	return c.(*quotaCounter)
+}
+
+// Open loads the counters from the file and saves them to it periodically.
+// Only the first call takes effect.
+func (s *QuotaStore) Open(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path != "" {
+		if s.path != path {
+			log.Printf("[warning] changes of quotaFile take effect after restarting")
+		}
+		return nil
+	}
+	usage, err := readQuotaFile(path)
+	if err != nil {
+		return err
+	}
+	// add to the traffic counted before opening, which is saved by the next flush
+	now := time.Now()
+	for id, u := range usage {
+		u.roll(now)
+		c := s.counter(id)
+		c.add(u, now)
+		c.flushed = u
+	}
+	s.path = path
+	go func() {
+		for range time.Tick(QuotaFlushInterval) {
+			if err := s.Flush(); err != nil {
+				log.Printf("[warning] failed to save quota usage: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Add counts n bytes of the server with the id.
+func (s *QuotaStore) Add(id string, n uint64) {
+	s.counter(id).add(QuotaUsage{DayBytes: n, MonthBytes: n, TotalBytes: n}, time.Now())
+	if atomic.LoadInt32(&s.dirty) == 0 {
+		atomic.StoreInt32(&s.dirty, 1)
+	}
+}
+
+// Usage returns the usage of the server with the id in the current periods.
+func (s *QuotaStore) Usage(id string) QuotaUsage {
+	now := time.Now()
+	if c, ok := s.counters.Load(id); ok {
+		return c.(*quotaCounter).usage(now)
+	}
+	var usage QuotaUsage
+	usage.roll(now)
+	return usage
+}
+
+// Exceeded reports whether the server has used up any of its quotas.
+func (s *QuotaStore) Exceeded(server *Server) bool {
+	if !server.HasQuota() {
+		return false
+	}
+	v, ok := s.counters.Load(server.QuotaID())
+	if !ok {
+		return false
+	}
+	c := v.(*quotaCounter)
+	c.roll(time.Now())
+	return server.DailyQuota > 0 && atomic.LoadUint64(&c.dayBytes) >= uint64(server.DailyQuota) ||
+		server.MonthlyQuota > 0 && atomic.LoadUint64(&c.monthBytes) >= uint64(server.MonthlyQuota) ||
+		server.TotalQuota > 0 && atomic.LoadUint64(&c.totalBytes) >= uint64(server.TotalQuota)
+}
+
+// Flush adds the traffic counted since the last flush to the file if changed,
+// and takes in the traffic the file has beyond the counters, e.g. counted by the other process during an upgrade.
+func (s *QuotaStore) Flush() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !atomic.CompareAndSwapInt32(&s.dirty, 1, 0) {
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			// retry on the next flush
+			atomic.StoreInt32(&s.dirty, 1)
+		}
+	}()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	usage, err := readQuotaFile(s.path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for id, u := range usage {
+		u.roll(now)
+		usage[id] = u
+	}
+	type merged struct {
+		c     *quotaCounter
+		usage QuotaUsage
+		other QuotaUsage
+	}
+	var counters []merged
+	s.counters.Range(func(id, v interface{}) bool {
+		c := v.(*quotaCounter)
+		cur := c.usage(now)
+		delta := cur.sub(c.flushed)
+		u := usage[id.(string)]
+		u.roll(now)
+		u.DayBytes += delta.DayBytes
+		u.MonthBytes += delta.MonthBytes
+		u.TotalBytes += delta.TotalBytes
+		usage[id.(string)] = u
+		counters = append(counters, merged{c: c, usage: u, other: u.sub(cur)})
+		return true
+	})
+	if err = writeQuotaFile(s.path, usage); err != nil {
+		return err
+	}
+	for _, m := range counters {
+		m.c.add(m.other, now)
+		m.c.flushed = m.usage
+	}
+	return nil
+}
+
+func readQuotaFile(path string) (map[string]QuotaUsage, error) {
+	usage := make(map[string]QuotaUsage)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func writeQuotaFile(path string, usage map[string]QuotaUsage) error {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it to avoid a corrupted file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// QuotaID returns the key of the counters of the server.
+func (s *Server) QuotaID() string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return s.Name
+}
+
+// AddUsage counts n bytes of the server if it has quotas.
+func (s *Server) AddUsage(n uint64) {
+	if s == nil || !s.HasQuota() {
+		return
+	}
+	Quota().Add(s.QuotaID(), n)
+}
+
+func (s *Server) HasQuota() bool {
+	return s.DailyQuota > 0 || s.MonthlyQuota > 0 || s.TotalQuota > 0
+}
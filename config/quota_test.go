@@ -0,0 +1,105 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaStore_Exceeded(t *testing.T) {
+	s := new(QuotaStore)
+	server := &Server{Name: "a", DailyQuota: 100, TotalQuota: 150}
+	if s.Exceeded(server) {
+		t.Fatal("exceeded without usage")
+	}
+	s.Add(server.QuotaID(), 99)
+	if s.Exceeded(server) {
+		t.Fatal("exceeded below the daily quota")
+	}
+	s.Add(server.QuotaID(), 1)
+	if !s.Exceeded(server) {
+		t.Fatal("not exceeded at the daily quota")
+	}
+
+	// a new day resets the daily usage but not the total
+	c := s.counter(server.QuotaID())
+	c.day, c.dayEnd = "2000-01-01", 0
+	if s.Exceeded(server) {
+		t.Fatal("exceeded on a new day")
+	}
+	s.Add(server.QuotaID(), 50)
+	if u := s.Usage(server.QuotaID()); u.DayBytes != 50 || u.TotalBytes != 150 {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+	if !s.Exceeded(server) {
+		t.Fatal("not exceeded at the total quota")
+	}
+
+	if s.Exceeded(&Server{Name: "a"}) {
+		t.Fatal("exceeded without quotas")
+	}
+}
+
+func TestQuotaStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s := new(QuotaStore)
+	s.Add("a", 10)
+	if err := s.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("a", 20)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := new(QuotaStore)
+	restarted.Add("a", 5)
+	if err := restarted.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	u := restarted.Usage("a")
+	if u.TotalBytes != 35 || u.Day != time.Now().Format(dayLayout) {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+}
+
+func TestQuotaStore_FlushUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	old := new(QuotaStore)
+	if err := old.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	old.Add("a", 10)
+	if err := old.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new process starts while the old one drains
+	upgraded := new(QuotaStore)
+	if err := upgraded.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	upgraded.Add("a", 5)
+	upgraded.Add("b", 1)
+	old.Add("a", 3)
+	if err := old.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgraded.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if u := upgraded.Usage("a"); u.DayBytes != 18 || u.TotalBytes != 18 {
+		t.Fatalf("unexpected usage after flushing: %+v", u)
+	}
+
+	restarted := new(QuotaStore)
+	if err := restarted.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if u := restarted.Usage("a"); u.TotalBytes != 18 {
+		t.Fatalf("unexpected usage of a: %+v", u)
+	}
+	if u := restarted.Usage("b"); u.TotalBytes != 1 {
+		t.Fatalf("unexpected usage of b: %+v", u)
+	}
+}
@@ -0,0 +1,6 @@
+package config
+
+// lockFile does nothing on Windows, where the process is not upgraded in place and saves the quota file alone.
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
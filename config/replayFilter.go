@@ -0,0 +1,101 @@
+package config
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/infra/bloom"
+)
+
+const (
+	DefaultReplayFilterFalsePositiveRate = 1e-6
+
+	// PacketWindowSize is the number of packet IDs below the highest one that a SIP022 UDP session remembers.
+	PacketWindowSize = 1024
+	// PacketWindowTTL is how long an idle SIP022 UDP session is remembered at least, longer than the NAT timeout of UDP.
+	PacketWindowTTL = 3 * time.Minute
+	// PacketWindowMaxSessions caps the SIP022 UDP sessions remembered per PacketWindowTTL, beyond which the oldest are forgotten earlier.
+	PacketWindowMaxSessions = 1 << 16
+
+	packetWindowShards = 16
+)
+
+// ReplayFilter remembers salts of authenticated requests, and packet IDs of SIP022 UDP sessions, to reject replayed ones.
+type ReplayFilter struct {
+	filter  *bloom.Rotating
+	windows [packetWindowShards]packetWindows
+}
+
+func NewReplayFilter(capacity int, falsePositiveRate float64, interval time.Duration) *ReplayFilter {
+	return &ReplayFilter{filter: bloom.NewRotating(capacity, falsePositiveRate, interval)}
+}
+
+// IsReplay reports whether the salt has been seen before, and remembers it if not.
+func (f *ReplayFilter) IsReplay(salt []byte) bool {
+	return f.filter.TestAndAdd(salt)
+}
+
+// IsReplayPacket reports whether the packet ID of the SIP022 UDP session has been seen before or is too old,
+// and remembers it if not.
+func (f *ReplayFilter) IsReplayPacket(sessionID uint64, packetID uint64) bool {
+	return f.windows[sessionID%packetWindowShards].isReplay(sessionID, packetID, time.Now())
+}
+
+// packetWindows holds the sliding windows of sessions seen in the current and the previous generation,
+// so that idle sessions are forgotten after one or two PacketWindowTTL, or once a generation is full.
+type packetWindows struct {
+	mu       sync.Mutex
+	current  map[uint64]*packetWindow
+	previous map[uint64]*packetWindow
+	rotated  time.Time
+}
+
+func (w *packetWindows) isReplay(sessionID uint64, packetID uint64, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current == nil || now.Sub(w.rotated) >= PacketWindowTTL {
+		w.previous, w.current = w.current, make(map[uint64]*packetWindow)
+		w.rotated = now
+	}
+	window, ok := w.current[sessionID]
+	if !ok {
+		if len(w.current) >= PacketWindowMaxSessions/packetWindowShards {
+			w.previous, w.current = w.current, make(map[uint64]*packetWindow)
+			w.rotated = now
+		}
+		if window, ok = w.previous[sessionID]; ok {
+			delete(w.previous, sessionID)
+		} else {
+			window = new(packetWindow)
+		}
+		w.current[sessionID] = window
+	}
+	return !window.accept(packetID)
+}
+
+// packetWindow is a sliding window of the packet IDs of a session as in RFC 6479.
+type packetWindow struct {
+	started bool
+	highest uint64
+	seen    [PacketWindowSize / 64]uint64
+}
+
+// accept reports whether the packet ID is new and within the window, and remembers it if so.
+func (w *packetWindow) accept(id uint64) bool {
+	if w.started && id <= w.highest {
+		if w.highest-id >= PacketWindowSize || w.seen[id/64%uint64(len(w.seen))]&(1<<(id%64)) != 0 {
+			return false
+		}
+	} else if w.started && id-w.highest < PacketWindowSize {
+		// forget the IDs sliding out of the window
+		for i := w.highest + 1; i < id; i++ {
+			w.seen[i/64%uint64(len(w.seen))] &^= 1 << (i % 64)
+		}
+		w.highest = id
+	} else {
+		w.seen = [PacketWindowSize / 64]uint64{}
+		w.started, w.highest = true, id
+	}
+	w.seen[id/64%uint64(len(w.seen))] |= 1 << (id % 64)
+	return true
+}
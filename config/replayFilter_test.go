@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+func TestReplayFilter_IsReplayPacket(t *testing.T) {
+	f := NewReplayFilter(100, DefaultReplayFilterFalsePositiveRate, 0)
+	for _, id := range []uint64{0, 1, 3, 2, 2000} {
+		if f.IsReplayPacket(1, id) {
+			t.Fatalf("packet %v should be new", id)
+		}
+	}
+	if !f.IsReplayPacket(1, 3) || !f.IsReplayPacket(1, 2000) {
+		t.Fatal("a seen packet should be a replay")
+	}
+	// packets out of order within the window are accepted once
+	if f.IsReplayPacket(1, 1990) || !f.IsReplayPacket(1, 1990) {
+		t.Fatal("a late packet within the window should be accepted once")
+	}
+	if !f.IsReplayPacket(1, 2000-PacketWindowSize) {
+		t.Fatal("a packet older than the window should be rejected")
+	}
+	// sessions are independent
+	if f.IsReplayPacket(2, 3) {
+		t.Fatal("the packet of another session should be new")
+	}
+}
+
+func TestReplayFilter_MaxSessions(t *testing.T) {
+	f := NewReplayFilter(100, DefaultReplayFilterFalsePositiveRate, 0)
+	for id := uint64(0); id < 4*PacketWindowMaxSessions; id++ {
+		f.IsReplayPacket(id, 0)
+	}
+	var sessions int
+	for i := range f.windows {
+		sessions += len(f.windows[i].current) + len(f.windows[i].previous)
+	}
+	if sessions > 2*PacketWindowMaxSessions {
+		t.Fatalf("expect at most %v sessions remembered, got %v", 2*PacketWindowMaxSessions, sessions)
+	}
+	// the latest sessions are still remembered
+	if !f.IsReplayPacket(4*PacketWindowMaxSessions-1, 0) {
+		t.Fatal("a seen packet of a recent session should be a replay")
+	}
+}
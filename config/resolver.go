@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/infra/resolver"
+)
+
+type ResolverConf struct {
+	// Address is the DNS server to resolve the targets, e.g. "1.1.1.1:53".
+	// Default: the system resolver, whose answers are cached for 60s within MinTTLSec and MaxTTLSec because their TTLs are unknown
+	Address string `json:"address"`
+
+	// MinTTLSec and MaxTTLSec bound the time to cache answers.
+	// Default: 5 and 3600
+	MinTTLSec int `json:"minTTLSec"`
+	MaxTTLSec int `json:"maxTTLSec"`
+
+	// NegativeTTLSec is the time to cache failed lookups.
+	// Default: 10
+	// Set to a negative value to disable negative caching.
+	NegativeTTLSec int `json:"negativeTTLSec"`
+
+	// TimeoutSec limits the time of a lookup.
+	// Default: 5
+	TimeoutSec int `json:"timeoutSec"`
+}
+
+var defaultResolver = resolver.New(resolver.Options{})
+
+// Resolver returns the resolver of the targets, which survives reloads to keep the cache.
+func Resolver() *resolver.Resolver {
+	return defaultResolver
+}
+
+func (rc ResolverConf) options() resolver.Options {
+	return resolver.Options{
+		Server:      rc.Address,
+		MinTTL:      time.Duration(rc.MinTTLSec) * time.Second,
+		MaxTTL:      time.Duration(rc.MaxTTLSec) * time.Second,
+		NegativeTTL: time.Duration(rc.NegativeTTLSec) * time.Second,
+		Timeout:     time.Duration(rc.TimeoutSec) * time.Second,
+	}
+}
+
+func (config *Config) CheckResolver() error {
+	rc := config.Resolver
+	if rc.Address != "" {
+		host, _, err := net.SplitHostPort(rc.Address)
+		if err != nil {
+			return fmt.Errorf("resolver: %w", err)
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("resolver: address should be an IP: %v", rc.Address)
+		}
+	}
+	if rc.MinTTLSec < 0 || rc.MaxTTLSec < 0 || rc.TimeoutSec < 0 {
+		return fmt.Errorf("resolver: TTLs and timeout should not be negative")
+	}
+	return nil
+}
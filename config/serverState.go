@@ -0,0 +1,72 @@
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type serverKey struct {
+	group  string
+	server string
+}
+
+// disabledServers remembers servers disabled at runtime, so that they stay disabled across reloads.
+var disabledServers = struct {
+	sync.Mutex
+	m map[serverKey]struct{}
+}{m: make(map[serverKey]struct{})}
+
+// Disabled reports whether the server is disabled at runtime. Disabled servers never pass auth.
+func (s *Server) Disabled() bool {
+	return atomic.LoadInt32(&s.disabled) != 0
+}
+
+// Available reports whether the server is allowed to pass auth, i.e. not disabled and within its quotas.
+func (s *Server) Available() bool {
+	return !s.Disabled() && !Quota().Exceeded(s)
+}
+
+func (s *Server) setDisabled(disabled bool) {
+	var v int32
+	if disabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.disabled, v)
+}
+
+// SetServerDisabled disables or enables the servers with the name in the groups with the name.
+// It returns the number of servers found.
+func (config *Config) SetServerDisabled(group string, server string, disabled bool) int {
+	key := serverKey{group: group, server: server}
+	disabledServers.Lock()
+	if disabled {
+		disabledServers.m[key] = struct{}{}
+	} else {
+		delete(disabledServers.m, key)
+	}
+	disabledServers.Unlock()
+	var cnt int
+	for i := range config.Groups {
+		g := &config.Groups[i]
+		if g.Name != group {
+			continue
+		}
+		for j := range g.Servers {
+			if g.Servers[j].Name == server {
+				g.Servers[j].setDisabled(disabled)
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+// BuildDisabledServers applies the runtime states of servers to the group.
+func (g *Group) BuildDisabledServers() {
+	disabledServers.Lock()
+	defer disabledServers.Unlock()
+	for i := range g.Servers {
+		_, disabled := disabledServers.m[serverKey{group: g.Name, server: g.Servers[i].Name}]
+		g.Servers[i].setDisabled(disabled)
+	}
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Qv2ray/mmp-go/infra/ratelimit"
+)
+
+type bucketPair struct {
+	up   *ratelimit.Bucket
+	down *ratelimit.Bucket
+}
+
+func newBucketPair(up, down int64) *bucketPair {
+	return &bucketPair{up: ratelimit.NewBucket(up), down: ratelimit.NewBucket(down)}
+}
+
+func (p *bucketPair) setRates(up, down int64) {
+	p.up.SetRate(up)
+	p.down.SetRate(down)
+}
+
+type clientBuckets struct {
+	*bucketPair
+	refs int
+}
+
+// Shaper holds the token buckets shaping the traffic of a group per server, in total and per client IP.
+// It survives reloads so that the limits of existing connections can be adjusted.
+type Shaper struct {
+	mu      sync.Mutex
+	group   *bucketPair
+	servers map[string]*bucketPair
+	clients map[string]*clientBuckets
+
+	clientUp   int64
+	clientDown int64
+}
+
+func NewShaper() *Shaper {
+	return &Shaper{
+		group:   newBucketPair(0, 0),
+		servers: make(map[string]*bucketPair),
+		clients: make(map[string]*clientBuckets),
+	}
+}
+
+// Update applies the limits of the group and its servers.
+func (s *Shaper) Update(g *Group) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group.setRates(g.UploadRateLimit, g.DownloadRateLimit)
+	s.clientUp, s.clientDown = g.ClientUploadRateLimit, g.ClientDownloadRateLimit
+	for _, c := range s.clients {
+		c.setRates(s.clientUp, s.clientDown)
+	}
+	servers := make(map[string]*bucketPair, len(g.Servers))
+	for i := range g.Servers {
+		server := &g.Servers[i]
+		p, ok := s.servers[server.Name]
+		if !ok {
+			p = newBucketPair(server.UploadRateLimit, server.DownloadRateLimit)
+		}
+		p.setRates(server.UploadRateLimit, server.DownloadRateLimit)
+		servers[server.Name] = p
+	}
+	// connections to removed servers keep their buckets
+	s.servers = servers
+}
+
+// Acquire returns the flow of a new connection or session from the ip to the server.
+func (s *Shaper) Acquire(server *Server, ip net.IP) *Flow {
+	if s == nil {
+		return nil
+	}
+	key := ip.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.servers[server.Name]
+	if !ok {
+		sp = newBucketPair(server.UploadRateLimit, server.DownloadRateLimit)
+		s.servers[server.Name] = sp
+	}
+	c, ok := s.clients[key]
+	if !ok {
+		c = &clientBuckets{bucketPair: newBucketPair(s.clientUp, s.clientDown)}
+		s.clients[key] = c
+	}
+	c.refs++
+	f := &Flow{
+		up:   [...]*ratelimit.Bucket{sp.up, s.group.up, c.up},
+		down: [...]*ratelimit.Bucket{sp.down, s.group.down, c.down},
+	}
+	f.release = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if c.refs--; c.refs == 0 {
+			delete(s.clients, key)
+		}
+	}
+	return f
+}
+
+// Flow shapes the traffic of a connection or session. A nil Flow is unlimited.
+type Flow struct {
+	up      [3]*ratelimit.Bucket
+	down    [3]*ratelimit.Bucket
+	release func()
+	once    sync.Once
+}
+
+func waitBuckets(buckets []*ratelimit.Bucket, n int) {
+	for _, b := range buckets {
+		b.Wait(n)
+	}
+}
+
+// chunk returns the most bytes to take from the buckets at a time so that each wait lasts about 100ms, or 0 if unlimited.
+func chunk(buckets []*ratelimit.Bucket) int {
+	var rate int64
+	for _, b := range buckets {
+		if r := b.Rate(); r > 0 && (rate == 0 || r < rate) {
+			rate = r
+		}
+	}
+	if rate == 0 {
+		return 0
+	}
+	if rate < 10 {
+		return 1
+	}
+	return int(rate / 10)
+}
+
+// WaitUp blocks until n bytes can be sent to the target.
+func (f *Flow) WaitUp(n int) {
+	if f != nil {
+		waitBuckets(f.up[:], n)
+	}
+}
+
+// WaitDown blocks until n bytes can be sent to the client.
+func (f *Flow) WaitDown(n int) {
+	if f != nil {
+		waitBuckets(f.down[:], n)
+	}
+}
+
+// UpChunk returns the most bytes to read from the client at a time before WaitUp, or 0 if unlimited.
+func (f *Flow) UpChunk() int {
+	if f == nil {
+		return 0
+	}
+	return chunk(f.up[:])
+}
+
+// DownChunk returns the most bytes to read from the target at a time before WaitDown, or 0 if unlimited.
+func (f *Flow) DownChunk() int {
+	if f == nil {
+		return 0
+	}
+	return chunk(f.down[:])
+}
+
+// AllowUp reports whether a packet of n bytes can be sent to the target now.
+func (f *Flow) AllowUp(n int) bool {
+	return f == nil || ratelimit.AllowAll(f.up[:], n)
+}
+
+// AllowDown reports whether a packet of n bytes can be sent to the client now.
+func (f *Flow) AllowDown(n int) bool {
+	return f == nil || ratelimit.AllowAll(f.down[:], n)
+}
+
+// Release should be called when the connection or session ends.
+func (f *Flow) Release() {
+	if f != nil {
+		f.once.Do(f.release)
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestShaper_Update(t *testing.T) {
+	g := &Group{
+		UploadRateLimit:         1000,
+		ClientDownloadRateLimit: 2000,
+		Servers:                 []Server{{Name: "a", DownloadRateLimit: 3000}},
+	}
+	g.BuildShaper()
+	ip := net.ParseIP("192.0.2.1")
+	f := g.Shaper.Acquire(&g.Servers[0], ip)
+	if f.up[1].Rate() != 1000 || f.down[0].Rate() != 3000 || f.down[2].Rate() != 2000 {
+		t.Fatal("unexpected rates")
+	}
+
+	// reloading adjusts the buckets of existing flows
+	newGroup := &Group{
+		UploadRateLimit:         500,
+		ClientDownloadRateLimit: 0,
+		Servers:                 []Server{{Name: "a", DownloadRateLimit: 4000}},
+	}
+	newGroup.InheritShaper(g)
+	if f.up[1].Rate() != 500 || f.down[0].Rate() != 4000 || f.down[2].Rate() != 0 {
+		t.Fatal("the rates of the existing flow should be updated")
+	}
+
+	// flows from the same IP share buckets
+	f2 := newGroup.Shaper.Acquire(&newGroup.Servers[0], ip)
+	if f2.down[2] != f.down[2] {
+		t.Fatal("flows from the same IP should share buckets")
+	}
+	f.Release()
+	f.Release()
+	f2.Release()
+	if len(newGroup.Shaper.clients) != 0 {
+		t.Fatal("buckets of the client should be removed after releasing")
+	}
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TargetFailover     = "failover"
+	TargetRoundRobin   = "round-robin"
+	TargetLeastConns   = "least-conns"
+	TargetClientIPHash = "client-ip-hash"
+)
+
+// Target is a backend address of servers. Servers of a group with the same address share the target.
+type Target struct {
+	Addr      string
+	conns     int32
+	unhealthy int32
+	// stop stops the health checker, or is nil if not checked
+	stop chan struct{}
+}
+
+// Conns returns the number of active TCP connections and UDP sessions to the target.
+func (t *Target) Conns() int {
+	return int(atomic.LoadInt32(&t.conns))
+}
+
+// Acquire counts a connection to the target until release is called.
+func (t *Target) Acquire() (release func()) {
+	atomic.AddInt32(&t.conns, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt32(&t.conns, -1)
+		})
+	}
+}
+
+// TargetSet holds the targets of a group and checks their health.
+// It survives reloads so that existing connections are still counted for least-conns, and the health is remembered.
+type TargetSet struct {
+	mu      sync.Mutex
+	targets map[string]*Target
+
+	group       string
+	healthCheck *HealthCheckConf
+	dialer      net.Dialer
+	preference  string
+	running     bool
+}
+
+func NewTargetSet() *TargetSet {
+	return &TargetSet{targets: make(map[string]*Target)}
+}
+
+// update takes the targets of the servers of the group and forgets the others.
+func (set *TargetSet) update(g *Group) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	targets := make(map[string]*Target, len(set.targets))
+	for i := range g.Servers {
+		s := &g.Servers[i]
+		addrs := s.TargetAddrs()
+		// servers remained by reloading share the slice with the old ones
+		s.targets = make([]*Target, 0, len(addrs))
+		for _, addr := range addrs {
+			t, ok := targets[addr]
+			if !ok {
+				if t, ok = set.targets[addr]; !ok {
+					t = &Target{Addr: addr}
+				}
+				targets[addr] = t
+			}
+			s.targets = append(s.targets, t)
+		}
+	}
+	for addr, t := range set.targets {
+		if _, ok := targets[addr]; !ok && t.stop != nil {
+			close(t.stop)
+			t.stop = nil
+		}
+	}
+	set.targets = targets
+
+	set.group = g.Name
+	set.healthCheck = nil
+	if g.HealthCheck != nil {
+		hc := *g.HealthCheck
+		set.healthCheck = &hc
+	}
+	// checks follow the outbound options of the group
+	set.dialer = g.Dialer(nil, "tcp")
+	set.preference = g.OutboundOf(nil).IPPreference
+	if set.running {
+		if set.healthCheck == nil {
+			set.stopCheckers()
+		} else {
+			set.startCheckers()
+		}
+	}
+}
+
+// TargetAddrs returns Target followed by Targets without duplicates.
+func (s *Server) TargetAddrs() []string {
+	addrs := make([]string, 0, 1+len(s.Targets))
+	seen := make(map[string]struct{}, cap(addrs))
+	for _, addr := range append([]string{s.Target}, s.Targets...) {
+		if _, ok := seen[addr]; ok || addr == "" {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// TargetList returns the targets of the server in the order of TargetAddrs.
+func (s *Server) TargetList() []*Target {
+	return s.targets
+}
+
+// PickTargets returns the targets of the server in the order to dial for a client of the ip by TargetStrategy.
+// Unhealthy targets are moved to the end.
+func (s *Server) PickTargets(ip net.IP) []*Target {
+	n := len(s.targets)
+	if n == 0 {
+		// e.g. the fallback
+		return []*Target{{Addr: s.Target}}
+	}
+	start := 0
+	switch s.TargetStrategy {
+	case TargetRoundRobin:
+		start = int((atomic.AddUint32(&s.next, 1) - 1) % uint32(n))
+	case TargetClientIPHash:
+		h := fnv.New32a()
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		h.Write(ip)
+		start = int(h.Sum32() % uint32(n))
+	}
+	targets := make([]*Target, 0, n)
+	targets = append(targets, s.targets[start:]...)
+	targets = append(targets, s.targets[:start]...)
+	if s.TargetStrategy == TargetLeastConns {
+		sort.SliceStable(targets, func(i, j int) bool {
+			return targets[i].Conns() < targets[j].Conns()
+		})
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Healthy() && !targets[j].Healthy()
+	})
+	return targets
+}
+
+func (g *Group) BuildTargets() {
+	g.TargetSet = NewTargetSet()
+	g.TargetSet.update(g)
+}
+
+// InheritTargets takes over the targets of the old group to keep counting existing connections.
+func (g *Group) InheritTargets(old *Group) {
+	if old.TargetSet == nil {
+		return
+	}
+	g.TargetSet = old.TargetSet
+	g.TargetSet.update(g)
+}
+
+func (config *Config) CheckTargets() error {
+	for _, g := range config.Groups {
+		for _, s := range g.Servers {
+			switch s.TargetStrategy {
+			case "", TargetFailover, TargetRoundRobin, TargetLeastConns, TargetClientIPHash:
+			default:
+				return fmt.Errorf("server %v: unknown targetStrategy: %v", s.Name, s.TargetStrategy)
+			}
+			for _, addr := range s.Targets {
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return fmt.Errorf("server %v: %w", s.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
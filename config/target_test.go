@@ -0,0 +1,57 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServer_PickTargets(t *testing.T) {
+	g := &Group{Servers: []Server{{Target: "a:1", Targets: []string{"b:1", "a:1", "c:1"}}}}
+	g.BuildTargets()
+	s := &g.Servers[0]
+	order := func(targets []*Target) (addrs string) {
+		for _, t := range targets {
+			addrs += t.Addr[:1]
+		}
+		return addrs
+	}
+	if o := order(s.PickTargets(nil)); o != "abc" {
+		t.Fatalf("failover: unexpected order %v", o)
+	}
+
+	s.TargetStrategy = TargetRoundRobin
+	for _, expected := range []string{"abc", "bca", "cab", "abc"} {
+		if o := order(s.PickTargets(nil)); o != expected {
+			t.Fatalf("round-robin: expect %v, got %v", expected, o)
+		}
+	}
+
+	s.TargetStrategy = TargetLeastConns
+	release := s.TargetList()[0].Acquire()
+	s.TargetList()[1].Acquire()
+	if o := order(s.PickTargets(nil)); o != "cab" {
+		t.Fatalf("least-conns: unexpected order %v", o)
+	}
+	release()
+	release()
+	if o := order(s.PickTargets(nil)); o != "acb" {
+		t.Fatalf("least-conns: unexpected order %v after release", o)
+	}
+
+	s.TargetStrategy = TargetClientIPHash
+	ip := net.ParseIP("192.0.2.1")
+	first := s.PickTargets(ip)[0]
+	for i := 0; i < 10; i++ {
+		if s.PickTargets(ip)[0] != first || s.PickTargets(ip.To16())[0] != first {
+			t.Fatal("client-ip-hash: a client should stick to a target")
+		}
+	}
+
+	// connections are still counted after reloading
+	newGroup := &Group{Servers: []Server{{Target: "b:1", Targets: []string{"d:1"}}}}
+	newGroup.BuildTargets()
+	newGroup.InheritTargets(g)
+	if targets := newGroup.Servers[0].TargetList(); targets[0] != s.TargetList()[1] || targets[0].Conns() != 1 || targets[1].Addr != "d:1" {
+		t.Fatalf("targets are not inherited: %v", targets)
+	}
+}
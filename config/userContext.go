@@ -3,8 +3,12 @@ package config
 import (
 	"github.com/Qv2ray/mmp-go/infra/lru"
 	"github.com/Qv2ray/mmp-go/infra/lrulist"
+	"github.com/Qv2ray/mmp-go/infra/pool"
 	"math/rand"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,14 +36,28 @@ func (ctx *UserContext) Close() error {
 	return ctx.Infra().Close()
 }
 
-func (ctx *UserContext) Auth(probe func(*Server) ([]byte, bool)) (hit *Server, content []byte) {
+// Prober tries to decrypt with the server's key. buf is a buffer to store decrypted text.
+type Prober func(buf []byte, server *Server) ([]byte, bool)
+
+// Auth probes servers in the order of preference. If workers > 1, servers are probed by
+// that many workers in parallel and the content of the hit is copied to buf.
+func (ctx *UserContext) Auth(buf []byte, workers int, probe Prober) (hit *Server, content []byte) {
 	lruList := ctx.Infra()
 	listCopy := lruList.GetListCopy()
 	defer lruList.GiveBackListCopy(listCopy)
+	if workers > len(listCopy) {
+		workers = len(listCopy)
+	}
+	if workers > 1 {
+		return parallelAuth(lruList, listCopy, buf, workers, probe)
+	}
 	// probe every server
 	for i := range listCopy {
 		server := listCopy[i].Val.(*Server)
-		if content, ok := probe(server); ok {
+		if !server.Available() {
+			continue
+		}
+		if content, ok := probe(buf, server); ok {
 			lruList.Promote(listCopy[i])
 			return server, content
 		}
@@ -47,6 +65,83 @@ func (ctx *UserContext) Auth(probe func(*Server) ([]byte, bool)) (hit *Server, c
 	return nil, nil
 }
 
+var (
+	authPoolOnce sync.Once
+	authPool     chan func()
+)
+
+// submitAuthTask runs the task on an idle worker of the auth pool, whose size bounds the CPU spent on parallel auth.
+// It returns false if all workers are busy.
+func submitAuthTask(task func()) bool {
+	authPoolOnce.Do(func() {
+		authPool = make(chan func())
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go func() {
+				for task := range authPool {
+					task()
+				}
+			}()
+		}
+	})
+	select {
+	case authPool <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+func parallelAuth(lruList *lrulist.LruList, listCopy []*lrulist.Node, buf []byte, workers int, probe Prober) (hit *Server, content []byte) {
+	var (
+		found   int32
+		hitNode *lrulist.Node
+		wg      sync.WaitGroup
+		pending []func()
+	)
+	// worker w probes the servers w, w+workers, w+2*workers, ... to keep the order of preference
+	run := func(w int) {
+		defer wg.Done()
+		b := pool.Get(len(buf))
+		defer pool.Put(b)
+		for i := w; i < len(listCopy); i += workers {
+			if atomic.LoadInt32(&found) != 0 {
+				// cancelled
+				return
+			}
+			server := listCopy[i].Val.(*Server)
+			if !server.Available() {
+				continue
+			}
+			if c, ok := probe(b, server); ok {
+				if atomic.CompareAndSwapInt32(&found, 0, 1) {
+					hitNode = listCopy[i]
+					content = buf[:copy(buf, c)]
+				}
+				return
+			}
+		}
+	}
+	wg.Add(workers)
+	for w := 1; w < workers; w++ {
+		w := w
+		task := func() { run(w) }
+		if !submitAuthTask(task) {
+			pending = append(pending, task)
+		}
+	}
+	run(0)
+	// the pool is busy, run the rest on our own
+	for _, task := range pending {
+		task()
+	}
+	wg.Wait()
+	if hitNode == nil {
+		return nil, nil
+	}
+	lruList.Promote(hitNode)
+	return hitNode.Val.(*Server), content
+}
+
 func (pool *UserContextPool) Infra() *lru.LRU {
 	return (*lru.LRU)(pool)
 }
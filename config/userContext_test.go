@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUserContext_ParallelAuth(t *testing.T) {
+	servers := make([]Server, 500)
+	for i := range servers {
+		servers[i].Name = fmt.Sprint(i)
+	}
+	ctx := NewUserContext(servers)
+	defer ctx.Close()
+
+	for _, workers := range []int{1, 4, 1000} {
+		for _, target := range []int{0, 1, 250, 499} {
+			var probed int32
+			buf := make([]byte, 16)
+			hit, content := ctx.Auth(buf, workers, func(buf []byte, server *Server) ([]byte, bool) {
+				atomic.AddInt32(&probed, 1)
+				if server != &servers[target] {
+					return nil, false
+				}
+				return buf[:copy(buf, server.Name)], true
+			})
+			if hit != &servers[target] || string(content) != servers[target].Name {
+				t.Fatalf("workers %v: expect hit %v, got %v", workers, target, hit)
+			}
+			if probed > int32(len(servers)) {
+				t.Fatalf("workers %v: probed %v times", workers, probed)
+			}
+		}
+		hit, _ := ctx.Auth(make([]byte, 16), workers, func(buf []byte, server *Server) ([]byte, bool) {
+			return nil, false
+		})
+		if hit != nil {
+			t.Fatalf("workers %v: unexpected hit", workers)
+		}
+	}
+}
@@ -1,19 +1,36 @@
 package dispatcher
 
 import (
-	"github.com/Qv2ray/mmp-go/config"
+	"context"
+	"os"
 	"sync"
+
+	"github.com/Qv2ray/mmp-go/config"
 )
 
 type Dispatcher interface {
+	// Bind listens on the address without serving yet. Listen calls it unless it has been called.
+	Bind() (err error)
+	// Listen serves until closed.
 	Listen() (err error)
 	// buf is a buffer to store decrypted text
 	Auth(buf []byte, data []byte, userContext *config.UserContext) (hit *config.Server, content []byte)
 	UpdateGroup(group *config.Group)
 	Close() (err error)
+	// Unlisten closes the listening sockets at once so that the address can be listened on again,
+	// leaving active connections to Shutdown.
+	Unlisten() (err error)
+	// Shutdown stops accepting new connections and waits for active ones to end.
+	// Active connections are force-closed when ctx is done.
+	Shutdown(ctx context.Context) (err error)
+	// Files returns duplicates of the listening sockets to hand to another process.
+	Files() (files []*os.File, err error)
+	// HandOver marks the sockets returned by Files as taken by another process,
+	// once it has confirmed to be ready.
+	HandOver()
 }
 
-type DispatcherCreator func(group *config.Group) Dispatcher
+type DispatcherCreator func(group *config.Group, addr config.ListenAddr) Dispatcher
 
 var mapDispatherCreator sync.Map
 
@@ -21,11 +38,11 @@ func Register(name string, creator DispatcherCreator) {
 	mapDispatherCreator.Store(name, creator)
 }
 
-func New(name string, group *config.Group) (Dispatcher, bool) {
+func New(name string, group *config.Group, addr config.ListenAddr) (Dispatcher, bool) {
 	c, ok := mapDispatherCreator.Load(name)
 	if !ok {
 		return nil, false
 	}
 	creator := c.(DispatcherCreator)
-	return creator(group), ok
+	return creator(group, addr), ok
 }
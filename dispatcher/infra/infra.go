@@ -1,9 +1,22 @@
 package infra
 
-import "errors"
+import (
+	"errors"
+	"net"
+)
 
 var ErrNetClosing = errors.New("use of closed network connection")
 
+// AddrIP returns the IP of a TCP or UDP address, or nil if unknown.
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
 
 func AddrLen(packet []byte) int {
 	if len(packet) < 5 {
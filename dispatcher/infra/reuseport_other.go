@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package infra
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePort is a Control function of net.ListenConfig setting SO_REUSEPORT,
+// so that several sockets can listen on the same address.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// ReusePortEnabled reports whether SO_REUSEPORT is set on the socket, e.g. one inherited from systemd.
+func ReusePortEnabled(c syscall.Conn) bool {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var v int
+	if e := rc.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT)
+	}); e != nil {
+		return false
+	}
+	return err == nil && v != 0
+}
@@ -0,0 +1,33 @@
+package infra
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestReusePortEnabled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if ReusePortEnabled(plain.(syscall.Conn)) {
+		t.Fatal("expect SO_REUSEPORT to be unset")
+	}
+
+	lc := net.ListenConfig{Control: ReusePort}
+	reused, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reused.Close()
+	if !ReusePortEnabled(reused.(syscall.Conn)) {
+		t.Fatal("expect SO_REUSEPORT to be set")
+	}
+}
@@ -0,0 +1,16 @@
+package infra
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ReusePort is not supported on Windows.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on Windows")
+}
+
+// ReusePortEnabled is always false on Windows.
+func ReusePortEnabled(c syscall.Conn) bool {
+	return false
+}
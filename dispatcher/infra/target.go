@@ -0,0 +1,23 @@
+package infra
+
+import (
+	"log"
+	"net"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/metrics"
+)
+
+// DialTargets dials the targets in turn until one succeeds, and returns the error of the last one if all of them fail.
+func DialTargets(protocol string, group string, targets []*config.Target, dial func(addr string) (net.Conn, error)) (c net.Conn, target *config.Target, err error) {
+	for i, t := range targets {
+		if c, err = dial(t.Addr); err == nil {
+			return c, t, nil
+		}
+		metrics.TargetDialFailures.With(group, t.Addr, protocol).Inc()
+		if i < len(targets)-1 {
+			log.Printf("[%s] dial %s error, trying the next target: %v", protocol, t.Addr, err)
+		}
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,86 @@
+package infra
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracker tracks the active connections of a dispatcher so that they can be drained.
+type Tracker struct {
+	mu      sync.Mutex
+	closers map[uint64]func()
+	nextID  uint64
+	// idle is closed when there is no active connection
+	idle chan struct{}
+}
+
+// Add tracks a connection. closer force-closes it. The returned done must be called when it ends.
+func (t *Tracker) Add(closer func()) (done func()) {
+	t.mu.Lock()
+	if t.closers == nil {
+		t.closers = make(map[uint64]func())
+	}
+	t.nextID++
+	id := t.nextID
+	t.closers[id] = closer
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.closers[id]; !ok {
+			return
+		}
+		delete(t.closers, id)
+		if len(t.closers) == 0 && t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+	}
+}
+
+// Len returns the number of active connections.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.closers)
+}
+
+func (t *Tracker) wait() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.closers) == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	return t.idle
+}
+
+// Drain waits for the active connections to end.
+// When ctx is done, the remaining connections are force-closed and ctx.Err() is returned after they end.
+func (t *Tracker) Drain(ctx context.Context) error {
+	select {
+	case <-t.wait():
+		return nil
+	case <-ctx.Done():
+	}
+	t.Close()
+	return ctx.Err()
+}
+
+// Close force-closes the active connections and waits for them to end.
+func (t *Tracker) Close() {
+	t.mu.Lock()
+	closers := make([]func(), 0, len(t.closers))
+	for _, c := range t.closers {
+		closers = append(closers, c)
+	}
+	t.mu.Unlock()
+	for _, c := range closers {
+		c()
+	}
+	<-t.wait()
+}
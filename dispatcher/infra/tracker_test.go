@@ -0,0 +1,34 @@
+package infra
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTracker_Drain(t *testing.T) {
+	var tr Tracker
+	done := tr.Add(func() {})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	if err := tr.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var forced bool
+	var d func()
+	d = tr.Add(func() {
+		forced = true
+		d()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tr.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if !forced || tr.Len() != 0 {
+		t.Fatal("remaining connections should be force-closed")
+	}
+}
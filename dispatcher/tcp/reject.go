@@ -0,0 +1,36 @@
+package tcp
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+)
+
+// reject handles the conn failing to auth according to the policy. n bytes have been read from the conn.
+func (d *TCP) reject(conn net.Conn, n int, policy string) {
+	switch policy {
+	case config.AuthFailDrain:
+		conn.SetReadDeadline(time.Time{})
+		io.Copy(io.Discard, conn)
+	case config.AuthFailRST:
+		limit := 1 + rand.Intn(d.group.AuthFailMaxRead())
+		if limit > n {
+			// the read deadline of auth still applies
+			io.CopyN(io.Discard, conn, int64(limit-n))
+		}
+		if c, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+			// send RST instead of FIN on close
+			c.SetLinger(0)
+		}
+	case config.AuthFailDelay:
+		delay := time.Duration(rand.Int63n(int64(d.group.AuthFailMaxDelay())))
+		conn.SetReadDeadline(time.Now().Add(delay))
+		io.Copy(io.Discard, conn)
+	case config.AuthFailHold:
+		// the read deadline of auth is set to AuthTimeoutSec
+		io.Copy(io.Discard, conn)
+	}
+}
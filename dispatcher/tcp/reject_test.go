@@ -0,0 +1,102 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+)
+
+// dialRejected sends garbage to a dispatcher of the group, and returns the result of reading the response
+// and how long it takes.
+func dialRejected(t *testing.T, g *config.Group, garbage int) (elapsed time.Duration, err error) {
+	g.Name = fmt.Sprint(t.Name(), time.Now().UnixNano())
+	g.Servers = []config.Server{{
+		Name:     "server",
+		Target:   "127.0.0.1:1",
+		Method:   "aes-256-gcm",
+		Password: "password",
+	}}
+	_, addr := listenGroup(t, g)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = c.Write(make([]byte, garbage)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	return time.Since(start), err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestReject_Drain(t *testing.T) {
+	// the auth timeout does not apply
+	_, err := dialRejected(t, &config.Group{AuthFailPolicy: config.AuthFailDrain, AuthTimeoutSec: 1}, 4096)
+	if !isTimeout(err) {
+		t.Fatalf("the connection should be kept open, got %v", err)
+	}
+}
+
+func TestReject_RST(t *testing.T) {
+	g := &config.Group{AuthFailPolicy: config.AuthFailRST, AuthFailMaxBytes: 100}
+	_, err := dialRejected(t, g, 200)
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("the connection should be reset after reading at most 100 bytes, got %v", err)
+	}
+
+	// wait for more bytes
+	g = &config.Group{AuthFailPolicy: config.AuthFailRST, AuthFailMaxBytes: 1 << 20}
+	_, err = dialRejected(t, g, BasicLen)
+	if !isTimeout(err) {
+		t.Fatalf("the connection should be kept open until enough bytes are read, got %v", err)
+	}
+}
+
+func TestReject_Delay(t *testing.T) {
+	elapsed, err := dialRejected(t, &config.Group{AuthFailPolicy: config.AuthFailDelay, AuthFailMaxDelaySec: 1}, 4096)
+	if err != io.EOF {
+		t.Fatalf("the connection should be closed with FIN, got %v", err)
+	}
+	if elapsed > 1500*time.Millisecond {
+		t.Fatalf("the delay should be less than 1s, got %v", elapsed)
+	}
+}
+
+func TestReject_Hold(t *testing.T) {
+	elapsed, err := dialRejected(t, &config.Group{AuthFailPolicy: config.AuthFailHold, AuthTimeoutSec: 1}, 4096)
+	if err != io.EOF {
+		t.Fatalf("the connection should be closed with FIN, got %v", err)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("the connection should be held for 1s, got %v", elapsed)
+	}
+}
+
+func TestReject_DrainOnAuthFail(t *testing.T) {
+	// the legacy option keeps the auth timeout
+	elapsed, err := dialRejected(t, &config.Group{DrainOnAuthFail: true, AuthTimeoutSec: 1}, 4096)
+	if err != io.EOF {
+		t.Fatalf("the connection should be closed after the auth timeout, got %v", err)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("the connection should be held for 1s, got %v", elapsed)
+	}
+
+	_, err = dialRejected(t, &config.Group{DrainOnAuthFail: true}, 4096)
+	if !isTimeout(err) {
+		t.Fatalf("the connection should be kept open without the auth timeout, got %v", err)
+	}
+}
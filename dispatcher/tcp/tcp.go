@@ -7,13 +7,21 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Qv2ray/mmp-go/cipher"
 	"github.com/Qv2ray/mmp-go/config"
 	"github.com/Qv2ray/mmp-go/dispatcher"
+	"github.com/Qv2ray/mmp-go/dispatcher/infra"
+	"github.com/Qv2ray/mmp-go/infra/activation"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
 	"github.com/Qv2ray/mmp-go/infra/pool"
+	"github.com/Qv2ray/mmp-go/infra/proxyproto"
+	"github.com/Qv2ray/mmp-go/metrics"
 	"github.com/database64128/tfo-go"
 )
 
@@ -21,6 +29,8 @@ import (
 const (
 	BasicLen = 32 + 2 + 16
 	MaxLen   = BasicLen + 16383 + 16
+	//[salt][encrypted fixed-length header][header tag]
+	MaxBasicLen = 32 + cipher.TCPRequestFixedHeaderLen + 16
 )
 
 func init() {
@@ -40,36 +50,126 @@ type DuplexConn interface {
 }
 
 type TCP struct {
-	gMutex sync.RWMutex
-	group  *config.Group
-	l      net.Listener
+	gMutex   sync.RWMutex
+	group    *config.Group
+	addr     config.ListenAddr
+	lMutex   sync.Mutex
+	ls       []net.Listener
+	releases []func() // give the inherited sockets of ls back to be taken again
+	closed   bool
+	tracker  infra.Tracker
 }
 
-func New(g *config.Group) (d dispatcher.Dispatcher) {
-	return &TCP{group: g}
+func New(g *config.Group, addr config.ListenAddr) (d dispatcher.Dispatcher) {
+	return &TCP{group: g, addr: addr}
+}
+
+// Bind listens on the address without accepting yet, so that errors show up before serving.
+// Listen calls it unless it has been called.
+func (d *TCP) Bind() (err error) {
+	d.gMutex.RLock()
+	shards := d.group.Shards()
+	d.gMutex.RUnlock()
+	var inherited syscall.Conn
+	for i := 0; i < shards; i++ {
+		l, release, err := d.inherit()
+		if err == nil && l == nil {
+			if inherited != nil && !infra.ReusePortEnabled(inherited) {
+				// listening on more would fail with EADDRINUSE
+				log.Printf("[warning] [tcp] listen on %v with %d of %d shards: more shards need SO_REUSEPORT on the inherited socket, e.g. ReusePort=yes in the systemd socket unit, or a restart instead of an upgrade\n", d.addr, i, shards)
+				break
+			}
+			l, release, err = d.listen(shards > 1)
+		} else if err == nil && i == 0 {
+			inherited, _ = l.(syscall.Conn)
+		}
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			log.Printf("[warning] [tcp] listen on %v with %d of %d shards: %v\n", d.addr, i, shards, err)
+			break
+		}
+		d.lMutex.Lock()
+		if d.closed {
+			d.lMutex.Unlock()
+			l.Close()
+			release()
+			break
+		}
+		d.ls = append(d.ls, l)
+		d.releases = append(d.releases, release)
+		d.lMutex.Unlock()
+	}
+	return nil
 }
 
 func (d *TCP) Listen() (err error) {
+	d.lMutex.Lock()
+	bound := len(d.ls) > 0
+	d.lMutex.Unlock()
+	if !bound {
+		if err = d.Bind(); err != nil {
+			return err
+		}
+	}
+	d.lMutex.Lock()
+	ls := append([]net.Listener(nil), d.ls...)
+	d.lMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			d.serve(l)
+		}(l)
+	}
+	wg.Wait()
+	return nil
+}
+
+// inherit takes a socket passed by systemd or the old process, or returns nil if none.
+// release should be called after closing l.
+func (d *TCP) inherit() (l net.Listener, release func(), err error) {
+	if l, release, err = activation.TakeListener(d.group.MatchSocket("tcp", d.addr)); l != nil {
+		log.Printf("[tcp] listen on %v inherited\n", d.addr)
+	}
+	return l, release, err
+}
+
+// listen listens on the address with SO_REUSEPORT if reusePort.
+func (d *TCP) listen(reusePort bool) (l net.Listener, release func(), err error) {
 	lc := tfo.ListenConfig{
 		DisableTFO: !d.group.ListenerTCPFastOpen,
 	}
-	d.l, err = lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", d.group.Port))
-	if err != nil {
-		return
+	if reusePort {
+		lc.Control = infra.ReusePort
+	}
+	if l, err = lc.Listen(context.Background(), d.addr.Network("tcp"), d.addr.String()); err != nil {
+		return nil, nil, err
 	}
-	defer d.l.Close()
-	log.Printf("[tcp] listen on :%v\n", d.group.Port)
+	log.Printf("[tcp] listen on %v\n", d.addr)
+	return l, func() {}, nil
+}
+
+// serve accepts connections from l until it is closed.
+func (d *TCP) serve(l net.Listener) {
+	defer l.Close()
 	for {
-		conn, err := d.l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return
 			}
 			log.Printf("[error] ReadFrom: %v", err)
 			continue
 		}
+		done := d.tracker.Add(func() {
+			conn.Close()
+		})
 		go func() {
-			err := d.handleConn(conn)
+			defer func() { done() }()
+			err := d.handleConn(conn, &done)
 			if err != nil {
 				log.Println(err)
 			}
@@ -83,16 +183,74 @@ func (d *TCP) UpdateGroup(group *config.Group) {
 	d.group = group
 }
 
+// Unlisten closes all shards at once, so that the address is free to listen on again.
+func (d *TCP) Unlisten() (err error) {
+	d.lMutex.Lock()
+	defer d.lMutex.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	for i, l := range d.ls {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+		d.releases[i]()
+	}
+	return err
+}
+
 func (d *TCP) Close() (err error) {
-	log.Printf("[tcp] closed :%v\n", d.group.Port)
-	return d.l.Close()
+	log.Printf("[tcp] closed %v\n", d.addr)
+	return d.Unlisten()
 }
 
-func (d *TCP) handleConn(conn net.Conn) error {
+func (d *TCP) Files() (files []*os.File, err error) {
+	d.lMutex.Lock()
+	defer d.lMutex.Unlock()
+	for _, l := range d.ls {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			err = fmt.Errorf("[tcp] %v cannot be handed over", d.addr)
+			break
+		}
+		f, e := fl.File()
+		if e != nil {
+			err = e
+			break
+		}
+		files = append(files, f)
+	}
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// HandOver does nothing, as closing the listeners here leaves the duplicates in the other process listening.
+func (d *TCP) HandOver() {}
+
+func (d *TCP) Shutdown(ctx context.Context) (err error) {
+	log.Printf("[tcp] draining %v, %d active connections\n", d.addr, d.tracker.Len())
+	err = d.Unlisten()
+	if e := d.tracker.Drain(ctx); e != nil {
+		log.Printf("[tcp] drain timeout %v, force-closed remaining connections\n", d.addr)
+	}
+	log.Printf("[tcp] closed %v\n", d.addr)
+	return err
+}
+
+// handleConn handles the conn tracked by done, which should be replaced if the way to force-close it changes.
+func (d *TCP) handleConn(conn net.Conn, done *func()) error {
 	/*
 	   https://github.com/shadowsocks/shadowsocks-org/blob/master/whitepaper/whitepaper.md
 	*/
 	defer conn.Close()
+	groupName := d.group.Name
+	metrics.GroupConnections.With(groupName, "tcp").Inc()
 
 	if d.group.AuthTimeoutSec > 0 {
 		conn.SetReadDeadline(time.Now().Add(time.Duration(d.group.AuthTimeoutSec) * time.Second))
@@ -100,33 +258,85 @@ func (d *TCP) handleConn(conn net.Conn) error {
 
 	data := pool.Get(MaxLen)
 	defer pool.Put(data)
-	buf := pool.Get(BasicLen)
+	buf := pool.Get(MaxBasicLen)
 	defer pool.Put(buf)
-	n, err := io.ReadAtLeast(conn, data, BasicLen)
-	if err != nil {
-		return fmt.Errorf("[tcp] %s <-x-> %s handleConn ReadAtLeast error: %w", conn.RemoteAddr(), conn.LocalAddr(), err)
+	headerLen := BasicLen
+	if d.group.TCPHeaderLen > headerLen {
+		// SIP022 requests have a longer fixed-length header
+		headerLen = d.group.TCPHeaderLen
 	}
 
-	// get user's context (preference)
-	d.gMutex.RLock() // avoid insert old servers to the new userContextPool
-	userContext := d.group.UserContextPool.GetOrInsert(conn.RemoteAddr(), d.group.Servers)
-	d.gMutex.RUnlock()
+	// the addresses of the client may be carried by a PROXY protocol header
+	clientAddr, localAddr := conn.RemoteAddr(), conn.LocalAddr()
+	src, dst, n, err := d.readProxyHeader(conn, data)
+	if err != nil {
+		return fmt.Errorf("[tcp] %s <-x-> %s handleConn PROXY protocol error: %w", clientAddr, localAddr, err)
+	}
+	if src != nil {
+		clientAddr, localAddr = src, dst
+	}
 
-	// auth every server
-	server, _ := d.Auth(buf, data, userContext)
-	if server == nil {
-		if d.group.DrainOnAuthFail {
-			log.Printf("[tcp] auth failed, draining conn %s <-> %s", conn.RemoteAddr(), conn.LocalAddr())
-			io.Copy(io.Discard, conn)
+	// limit connections by the address of the client rather than the proxy
+	if d.group.Limiter != nil {
+		release, limit := d.group.Limiter.Acquire(infra.AddrIP(clientAddr), "tcp")
+		if release == nil {
+			log.Printf("[tcp] %s <-x-> %s rejected by the %s limit", clientAddr, localAddr, limit)
+			metrics.GroupLimitRejections.With(groupName, "tcp", limit).Inc()
 			return nil
 		}
+		defer release()
+	}
+
+	m, err := io.ReadAtLeast(conn, data[n:], headerLen-n)
+	n += m
+	if err != nil {
+		return fmt.Errorf("[tcp] %s <-x-> %s handleConn ReadAtLeast error: %w", clientAddr, localAddr, err)
+	}
 
-		if len(d.group.Servers) == 0 {
+	// look up the user by the identity header
+	server, _ := d.AuthIdentity(buf, data[:n])
+	if server != nil {
+		// the target knows nothing about the identity PSK
+		conf := cipher.CiphersConf[server.Method]
+		copy(data[cipher.IdentityHeaderLen:], data[:conf.SaltLen])
+		data = data[cipher.IdentityHeaderLen:]
+		n -= cipher.IdentityHeaderLen
+	} else {
+		// get user's context (preference)
+		d.gMutex.RLock() // avoid insert old servers to the new userContextPool
+		userContext := d.group.UserContextPool.GetOrInsert(clientAddr, d.group.Servers)
+		d.gMutex.RUnlock()
+
+		// auth every server
+		server, _ = d.Auth(buf, data[:n], userContext)
+	}
+	if server != nil && d.group.ReplayFilter != nil {
+		salt := data[:cipher.CiphersConf[server.Method].SaltLen]
+		if d.group.ReplayFilter.IsReplay(salt) {
+			log.Printf("[tcp] replayed salt from %s, rejected", clientAddr)
+			metrics.GroupReplays.With(groupName, "tcp").Inc()
+			server = nil
+		}
+	}
+	if server == nil {
+		metrics.GroupAuthFailures.With(groupName, "tcp").Inc()
+		if policy := d.group.AuthFailAction(); policy != config.AuthFailFallback {
+			log.Printf("[tcp] auth failed, %s conn %s <-> %s", policy, clientAddr, localAddr)
+			metrics.GroupRejections.With(groupName, policy).Inc()
+			if policy == config.AuthFailDrain {
+				metrics.GroupDrains.With(groupName).Inc()
+			}
+			d.reject(conn, n, policy)
 			return nil
 		}
 
 		// fallback
-		server = &d.group.Servers[0]
+		if server = d.group.FallbackServer(); server == nil {
+			return nil
+		}
+		metrics.GroupFallbacks.With(groupName).Inc()
+	} else {
+		metrics.GroupAuthSuccesses.With(groupName, "tcp").Inc()
 	}
 
 	if d.group.AuthTimeoutSec > 0 {
@@ -134,63 +344,244 @@ func (d *TCP) handleConn(conn net.Conn) error {
 	}
 
 	// dial and relay
-	dialer := tfo.Dialer{
-		DisableTFO: !server.TCPFastOpen,
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		// tfo.Dialer swaps its Control during a dial, so each of the parallel attempts of happy eyeballs needs its own
+		dialer := tfo.Dialer{
+			Dialer:     d.group.Dialer(server, "tcp"),
+			DisableTFO: !server.TCPFastOpen,
+		}
+		return dialer.DialContext(ctx, network, address)
 	}
-	dialer.Timeout = time.Duration(d.group.DialTimeoutSec) * time.Second
-	rc, err := dialer.Dial("tcp", server.Target)
+	rc, target, err := infra.DialTargets("tcp", groupName, server.PickTargets(infra.AddrIP(clientAddr)), func(addr string) (net.Conn, error) {
+		return d.group.DialTarget(server, "tcp", addr, dial)
+	})
 	if err != nil {
-		return fmt.Errorf("[tcp] %s <-> %s <-x-> %s handleConn dial error: %w", conn.RemoteAddr(), conn.LocalAddr(), server.Target, err)
+		return fmt.Errorf("[tcp] %s <-> %s <-x-> %s handleConn dial error: %w", clientAddr, localAddr, server.Name, err)
+	}
+	defer target.Acquire()()
+	if !d.group.OutboundOf(server).NoDelay() {
+		if tc, ok := rc.(interface{ SetNoDelay(bool) error }); ok {
+			_ = tc.SetNoDelay(false)
+		}
 	}
 
-	_, err = rc.Write(data[:n])
+	payload := data[:n]
+	if v := d.group.ProxyProtocolVersion(server); v != 0 {
+		payload = append(proxyproto.AppendHeader(nil, v, clientAddr, localAddr), payload...)
+	}
+	_, err = rc.Write(payload)
 	if err != nil {
-		return fmt.Errorf("[tcp] %s <-> %s <-x-> %s handleConn write error: %w", conn.RemoteAddr(), conn.LocalAddr(), server.Target, err)
+		return fmt.Errorf("[tcp] %s <-> %s <-x-> %s handleConn write error: %w", clientAddr, localAddr, target.Addr, err)
 	}
 
-	log.Printf("[tcp] %s <-> %s <-> %s", conn.RemoteAddr(), conn.LocalAddr(), server.Target)
+	log.Printf("[tcp] %s <-> %s <-> %s", clientAddr, localAddr, target.Addr)
 
-	if err := relay(conn.(DuplexConn), rc.(DuplexConn)); err != nil {
+	active := metrics.ServerTCPConnections.With(groupName, server.Name)
+	active.Inc()
+	defer active.Dec()
+	up := metrics.ServerBytes.With(groupName, server.Name, "tcp", "up")
+	down := metrics.ServerBytes.With(groupName, server.Name, "tcp", "down")
+	up.Add(uint64(n))
+
+	entry := conntrack.Default.Add(&conntrack.Conn{
+		Protocol: "tcp",
+		Client:   clientAddr,
+		Group:    groupName,
+		Server:   server.Name,
+		Target:   target.Addr,
+	}, func() {
+		conn.Close()
+		rc.Close()
+	})
+	defer conntrack.Default.Remove(entry)
+	entry.AddUp(uint64(n))
+	server.AddUsage(uint64(n))
+	// force-closing closes the target as well
+	untrack := *done
+	*done = d.tracker.Add(entry.Close)
+	untrack()
+
+	flow := d.group.Shaper.Acquire(server, infra.AddrIP(clientAddr))
+	defer flow.Release()
+
+	var timeouts relayTimeouts
+	timeouts.idle, timeouts.lifetime, timeouts.halfClose = d.group.RelayTimeouts()
+	closedBy, err := relay(conn.(DuplexConn), rc.(DuplexConn), up, down, entry, server, flow, timeouts)
+	if closedBy != "" {
+		log.Printf("[tcp] %s <-> %s <-> %s closed by %s timeout", clientAddr, localAddr, target.Addr, closedBy)
+		metrics.GroupTCPTimeouts.With(groupName, closedBy).Inc()
+		return nil
+	}
+	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
 			return nil // ignore i/o timeout
 		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil // killed
+		}
 		return fmt.Errorf("[tcp] handleConn relay error: %w", err)
 	}
 	return nil
 }
 
-func relay(lc, rc DuplexConn) error {
+// readProxyHeader reads the PROXY protocol header sent by a trusted proxy into data.
+// It returns the addresses in the header and the number of bytes following the header in data.
+func (d *TCP) readProxyHeader(conn net.Conn, data []byte) (src, dst net.Addr, n int, err error) {
+	mode := d.group.AcceptProxyProtocol
+	if mode != "optional" && mode != "required" {
+		return nil, nil, 0, nil
+	}
+	if !d.group.TrustProxy(conn.RemoteAddr()) {
+		if mode == "required" {
+			return nil, nil, 0, fmt.Errorf("untrusted source of PROXY protocol headers")
+		}
+		return nil, nil, 0, nil
+	}
+	for n < len(data) {
+		m, err := conn.Read(data[n:])
+		n += m
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		src, dst, headerLen, err := proxyproto.Parse(data[:n])
+		switch err {
+		case nil:
+			return src, dst, copy(data, data[headerLen:n]), nil
+		case proxyproto.ErrIncomplete:
+			continue
+		case proxyproto.ErrNoHeader:
+			if mode == "required" {
+				return nil, nil, 0, err
+			}
+			return nil, nil, n, nil
+		default:
+			return nil, nil, 0, err
+		}
+	}
+	return nil, nil, 0, proxyproto.ErrInvalid
+}
+
+// countingReader adds the bytes read to the counters and the quota usage, refreshes the watchdog and waits for the rate limits.
+type countingReader struct {
+	io.Reader
+	counter  *metrics.Counter
+	add      func(n uint64)
+	server   *config.Server
+	watchdog *watchdog
+	wait     func(n int)
+	chunk    func() int
+}
+
+func (r countingReader) Read(p []byte) (n int, err error) {
+	// read little at a time when shaped, so that no wait outlasts the idle timeout
+	if c := r.chunk(); c > 0 && len(p) > c {
+		p = p[:c]
+	}
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.counter.Add(uint64(n))
+		r.add(uint64(n))
+		r.server.AddUsage(uint64(n))
+		r.wait(n)
+		// a relay waiting for the rate limits is not idle
+		r.watchdog.Touch()
+	}
+	return
+}
+
+// relay copies data between lc and rc until both directions end or a timeout closes them.
+// closedBy is the timeout which closed them, or "" if none.
+func relay(lc, rc DuplexConn, up, down *metrics.Counter, entry *conntrack.Conn, server *config.Server, flow *config.Flow, timeouts relayTimeouts) (closedBy string, err error) {
 	defer rc.Close()
+	w := newWatchdog(timeouts, func() {
+		lc.Close()
+		rc.Close()
+	})
 	ch := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(lc, rc)
+		_, err := io.Copy(lc, countingReader{rc, down, entry.AddDown, server, w, flow.WaitDown, flow.DownChunk})
 		lc.CloseWrite()
+		w.HalfClose()
 		ch <- err
 	}()
-	_, err := io.Copy(rc, lc)
+	_, err = io.Copy(rc, countingReader{lc, up, entry.AddUp, server, w, flow.WaitUp, flow.UpChunk})
 	rc.CloseWrite()
+	w.HalfClose()
 	innerErr := <-ch
+	if closedBy = w.Stop(); closedBy != "" {
+		return closedBy, nil
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	return innerErr
+	return "", innerErr
 }
 
 func (d *TCP) Auth(buf []byte, data []byte, userContext *config.UserContext) (hit *config.Server, content []byte) {
-	if len(data) < BasicLen {
-		return nil, nil
-	}
-	return userContext.Auth(func(server *config.Server) ([]byte, bool) {
+	d.gMutex.RLock()
+	workers := d.group.AuthWorkers()
+	groupName := d.group.Name
+	d.gMutex.RUnlock()
+	var depth int32
+	hit, content = userContext.Auth(buf, workers, func(buf []byte, server *config.Server) ([]byte, bool) {
+		atomic.AddInt32(&depth, 1)
 		return probe(buf, data, server)
 	})
+	if hit != nil {
+		metrics.AuthProbeDepth.With(groupName, "tcp").Observe(float64(atomic.LoadInt32(&depth)))
+	}
+	return hit, content
+}
+
+// AuthIdentity looks up the server by the SIP022 identity header of the request.
+func (d *TCP) AuthIdentity(buf []byte, data []byte) (hit *config.Server, content []byte) {
+	d.gMutex.RLock()
+	group := d.group
+	d.gMutex.RUnlock()
+	if group.Identities == nil {
+		return nil, nil
+	}
+	keyLen := len(group.IdentityKey)
+	//[salt][identity header][encrypted fixed-length header][header tag]
+	if len(data) < keyLen+cipher.IdentityHeaderLen {
+		return nil, nil
+	}
+	h, err := cipher.DecryptTCPIdentityHeader(group.IdentityKey, data[:keyLen], data[keyLen:])
+	if err != nil {
+		return nil, nil
+	}
+	i, ok := group.Identities[h]
+	if !ok {
+		return nil, nil
+	}
+	server := &group.Servers[i]
+	if !server.Available() {
+		return nil, nil
+	}
+	conf := cipher.CiphersConf[server.Method]
+	if len(data) < conf.TCPHeaderLen()+cipher.IdentityHeaderLen {
+		return nil, nil
+	}
+	salt := data[:conf.SaltLen]
+	cipherText := data[conf.SaltLen+cipher.IdentityHeaderLen : conf.TCPHeaderLen()+cipher.IdentityHeaderLen]
+	if content, ok := conf.VerifyTCPRequestHeader(buf, server.MasterKey, salt, cipherText); ok {
+		return server, content
+	}
+	return nil, nil
 }
 
 func probe(buf []byte, data []byte, server *config.Server) ([]byte, bool) {
 	//[salt][encrypted payload length][length tag][encrypted payload][payload tag]
 	conf := cipher.CiphersConf[server.Method]
+	if len(data) < conf.TCPHeaderLen() {
+		return nil, false
+	}
 
 	salt := data[:conf.SaltLen]
-	cipherText := data[conf.SaltLen : conf.SaltLen+2+conf.TagLen]
+	cipherText := data[conf.SaltLen:conf.TCPHeaderLen()]
 
+	if conf.SIP022 {
+		return conf.VerifyTCPRequestHeader(buf, server.MasterKey, salt, cipherText)
+	}
 	return conf.Verify(buf, server.MasterKey, salt, cipherText, nil)
 }
@@ -0,0 +1,134 @@
+package tcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+// stalledListener listens on [::1]:port with a full accept queue, so that Linux drops SYNs and dials hang.
+func stalledListener(t *testing.T, port int) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: port}); err == nil {
+		err = unix.Listen(fd, 0)
+	}
+	if err != nil {
+		unix.Close(fd)
+		t.Skip(err)
+	}
+	f := os.NewFile(uintptr(fd), "")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+}
+
+// serveDNS answers A and AAAA queries of any name with ips, and returns the address of the server.
+func serveDNS(t *testing.T, ips ...net.IP) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+			for _, ip := range ips {
+				header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+				if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+					var a dnsmessage.AResource
+					copy(a.A[:], ip4)
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &a})
+				} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+					var aaaa dnsmessage.AAAAResource
+					copy(aaaa.AAAA[:], ip)
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &aaaa})
+				}
+			}
+			b, _ := resp.Pack()
+			conn.WriteTo(b, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestDispatcher_DialTFOParallel dials a dual-stack target with TCP Fast Open, whose IPv6 attempt hangs
+// while the IPv4 one is started by happy eyeballs. Run with -race to catch the attempts sharing a dialer.
+func TestDispatcher_DialTFOParallel(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	port := backend.Addr().(*net.TCPAddr).Port
+	stalledListener(t, port)
+
+	config.Resolver().SetOptions(resolver.Options{Server: serveDNS(t, net.IPv6loopback, net.IPv4(127, 0, 0, 1))})
+	defer config.Resolver().SetOptions(resolver.Options{})
+
+	g := &config.Group{
+		Name: t.Name(),
+		Servers: []config.Server{{
+			Name:        "server",
+			Target:      net.JoinHostPort("dual.test", strconv.Itoa(port)),
+			Method:      "aes-256-gcm",
+			Password:    "password",
+			TCPFastOpen: true,
+		}},
+	}
+	_, addr := listenGroup(t, g)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := newRequest(&g.Servers[0])
+	c.Write(request)
+
+	backend.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b := make([]byte, len(request))
+	rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(rc, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, request) {
+		t.Fatalf("unexpected bytes received by the target: %q", b)
+	}
+}
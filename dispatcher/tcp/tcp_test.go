@@ -1,15 +1,39 @@
 package tcp
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Qv2ray/mmp-go/cipher"
 	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
+	"github.com/Qv2ray/mmp-go/infra/proxyproto"
+	"github.com/Qv2ray/mmp-go/metrics"
+	"io"
 	"math/rand"
 	"net"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
+
+	"lukechampine.com/blake3"
 )
 
 func BenchmarkDispatcher_Auth(b *testing.B) {
+	benchmarkAuth(b, new(config.Group))
+}
+
+func BenchmarkDispatcher_ParallelAuth(b *testing.B) {
+	benchmarkAuth(b, &config.Group{ParallelAuthThreshold: 1})
+}
+
+func benchmarkAuth(b *testing.B, g *config.Group) {
 	const nServers = 100
-	g := new(config.Group)
 	for i := 0; i < nServers; i++ {
 		var b [10]byte
 		rand.Read(b[:])
@@ -23,9 +47,800 @@ func BenchmarkDispatcher_Auth(b *testing.B) {
 	g.BuildUserContextPool(10)
 	var buf [50]byte
 	var data [50]byte
-	var d = New(g)
+	var d = New(g, config.ListenAddr{Port: g.Port})
 	addr, _ := net.ResolveIPAddr("tcp", "127.0.0.1:50000")
 	for i := 0; i < b.N; i++ {
 		d.Auth(buf[:], data[:], g.UserContextPool.GetOrInsert(addr, g.Servers))
 	}
 }
+
+func TestDispatcher_Auth2022(t *testing.T) {
+	for _, method := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305"} {
+		conf := cipher.CiphersConf[method]
+		psk := make([]byte, conf.KeyLen)
+		rand.Read(psk)
+		g := new(config.Group)
+		g.Servers = []config.Server{{
+			Target:   "127.0.0.1:1080",
+			Method:   method,
+			Password: base64.StdEncoding.EncodeToString(psk),
+		}}
+		g.BuildMasterKeys()
+		g.BuildUserContextPool(10)
+		d := New(g, config.ListenAddr{Port: g.Port})
+		addr, _ := net.ResolveIPAddr("tcp", "127.0.0.1:50000")
+
+		request := func(timestamp time.Time) []byte {
+			salt := make([]byte, conf.SaltLen)
+			rand.Read(salt)
+			header := make([]byte, cipher.TCPRequestFixedHeaderLen)
+			header[0] = cipher.HeaderTypeClient
+			binary.BigEndian.PutUint64(header[1:], uint64(timestamp.Unix()))
+			binary.BigEndian.PutUint16(header[9:], 32)
+			sk := make([]byte, conf.KeyLen)
+			conf.DeriveSubKey(sk, psk, salt)
+			aead, _ := conf.NewCipher(sk)
+			return aead.Seal(salt, cipher.ZeroNonce[:conf.NonceLen], header, nil)
+		}
+
+		var buf [MaxBasicLen]byte
+		if hit, _ := d.Auth(buf[:], request(time.Now()), g.UserContextPool.GetOrInsert(addr, g.Servers)); hit == nil {
+			t.Errorf("%v: failed to auth a valid request", method)
+		}
+		if hit, _ := d.Auth(buf[:], request(time.Now().Add(time.Minute)), g.UserContextPool.GetOrInsert(addr, g.Servers)); hit != nil {
+			t.Errorf("%v: request with a future timestamp passed auth", method)
+		}
+		if hit, _ := d.Auth(buf[:], request(time.Now())[:conf.SaltLen+4], g.UserContextPool.GetOrInsert(addr, g.Servers)); hit != nil {
+			t.Errorf("%v: truncated request passed auth", method)
+		}
+	}
+}
+
+func TestDispatcher_AuthIdentity(t *testing.T) {
+	const method = "2022-blake3-aes-256-gcm"
+	conf := cipher.CiphersConf[method]
+	ipsk := make([]byte, conf.KeyLen)
+	rand.Read(ipsk)
+	g := &config.Group{IdentityPSK: base64.StdEncoding.EncodeToString(ipsk)}
+	upsks := make([][]byte, 100)
+	for i := range upsks {
+		upsks[i] = make([]byte, conf.KeyLen)
+		rand.Read(upsks[i])
+		g.Servers = append(g.Servers, config.Server{
+			Target:   "127.0.0.1:1080",
+			Method:   method,
+			Password: base64.StdEncoding.EncodeToString(upsks[i]),
+		})
+	}
+	g.BuildMasterKeys()
+	g.BuildIdentities()
+	g.BuildUserContextPool(10)
+	d := New(g, config.ListenAddr{Port: g.Port}).(*TCP)
+
+	request := func(ipsk, upsk []byte) []byte {
+		salt := make([]byte, conf.SaltLen)
+		rand.Read(salt)
+		isk := make([]byte, conf.KeyLen)
+		blake3.DeriveKey(isk, cipher.IdentitySubKeyContext, append(append([]byte{}, ipsk...), salt...))
+		block, _ := aes.NewCipher(isk)
+		h := cipher.NewPSKHash(upsk)
+		eih := make([]byte, cipher.IdentityHeaderLen)
+		block.Encrypt(eih, h[:])
+
+		header := make([]byte, cipher.TCPRequestFixedHeaderLen)
+		header[0] = cipher.HeaderTypeClient
+		binary.BigEndian.PutUint64(header[1:], uint64(time.Now().Unix()))
+		sk := make([]byte, conf.KeyLen)
+		conf.DeriveSubKey(sk, upsk, salt)
+		aead, _ := conf.NewCipher(sk)
+		return aead.Seal(append(salt, eih...), cipher.ZeroNonce[:conf.NonceLen], header, nil)
+	}
+
+	var buf [MaxBasicLen]byte
+	if hit, _ := d.AuthIdentity(buf[:], request(ipsk, upsks[42])); hit != &g.Servers[42] {
+		t.Error("failed to look up the user by the identity header")
+	}
+	if hit, _ := d.AuthIdentity(buf[:], request(upsks[1], upsks[42])); hit != nil {
+		t.Error("request with a wrong identity PSK passed auth")
+	}
+	mismatched := request(ipsk, upsks[42])
+	copy(mismatched[conf.SaltLen+cipher.IdentityHeaderLen:], request(ipsk, upsks[43])[conf.SaltLen+cipher.IdentityHeaderLen:])
+	if hit, _ := d.AuthIdentity(buf[:], mismatched); hit != nil {
+		t.Error("request with a mismatched user PSK passed auth")
+	}
+}
+
+// newRequest returns the beginning of a request to the server, which is enough to pass auth.
+func newRequest(server *config.Server) []byte {
+	conf := cipher.CiphersConf[server.Method]
+	salt := make([]byte, conf.SaltLen)
+	rand.Read(salt)
+	sk := make([]byte, conf.KeyLen)
+	conf.DeriveSubKey(sk, server.MasterKey, salt)
+	aead, _ := conf.NewCipher(sk)
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], 7)
+	request := aead.Seal(salt, cipher.ZeroNonce[:conf.NonceLen], length[:], nil)
+	// the payload chunk is not verified by mmp-go
+	padding := make([]byte, 7+conf.TagLen)
+	rand.Read(padding)
+	return append(request, padding...)
+}
+
+// listenGroup starts a TCP dispatcher of the group on a random port.
+func listenGroup(t *testing.T, g *config.Group) (d *TCP, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if g.UserContextPool == nil {
+		g.BuildUserContextPool(time.Minute)
+	}
+	g.BuildMasterKeys()
+	d = New(g, config.ListenAddr{Port: g.Port}).(*TCP)
+	go d.Listen()
+	addr = l.Addr().String()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Cleanup(func() { d.Close() })
+			return d, addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("dispatcher does not listen")
+	return nil, ""
+}
+
+func TestDispatcher_ProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	for _, version := range []string{"v1", "v2"} {
+		g := &config.Group{
+			ProxyProtocol: version,
+			Servers: []config.Server{{
+				Target:   backend.Addr().String(),
+				Method:   "aes-256-gcm",
+				Password: "password",
+			}},
+		}
+		_, addr := listenGroup(t, g)
+
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := newRequest(&g.Servers[0])
+		c.Write(request)
+
+		rc, err := backend.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := proxyproto.ParseVersion(version)
+		header := proxyproto.AppendHeader(nil, v, c.LocalAddr(), c.RemoteAddr())
+		b := make([]byte, len(header)+len(request))
+		rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(rc, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, append(header, request...)) {
+			t.Errorf("%v: unexpected bytes received by the target: %q", version, b)
+		}
+		c.Close()
+		rc.Close()
+	}
+}
+
+func TestDispatcher_AcceptProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	newGroup := func(mode string, trusted ...string) *config.Group {
+		g := &config.Group{
+			AcceptProxyProtocol:       mode,
+			ProxyProtocolTrustedCIDRs: trusted,
+			ProxyProtocol:             "v1",
+			AuthTimeoutSec:            1,
+			Servers: []config.Server{{
+				Target:   backend.Addr().String(),
+				Method:   "chacha20-ietf-poly1305",
+				Password: "password",
+			}},
+		}
+		g.BuildTrustedProxies()
+		return g
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+
+	// expect returns the header the target should receive, or nil if the connection should be rejected
+	tests := []struct {
+		group  *config.Group
+		header func(c net.Conn) []byte
+		expect func(c net.Conn) []byte
+	}{
+		{
+			group:  newGroup("required", "127.0.0.0/8"),
+			header: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version2, src, dst) },
+			expect: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version1, src, dst) },
+		},
+		{
+			group:  newGroup("optional", "127.0.0.0/8"),
+			header: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version1, src, dst) },
+			expect: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version1, src, dst) },
+		},
+		{
+			group:  newGroup("optional", "127.0.0.0/8"),
+			header: func(c net.Conn) []byte { return nil },
+			expect: func(c net.Conn) []byte {
+				return proxyproto.AppendHeader(nil, proxyproto.Version1, c.LocalAddr(), c.RemoteAddr())
+			},
+		},
+		{
+			group:  newGroup("required", "127.0.0.0/8"),
+			header: func(c net.Conn) []byte { return nil },
+			expect: func(c net.Conn) []byte { return nil },
+		},
+		{
+			// no source is trusted by default
+			group:  newGroup("required"),
+			header: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version1, src, dst) },
+			expect: func(c net.Conn) []byte { return nil },
+		},
+		{
+			// untrusted sources cannot send headers
+			group:  newGroup("required", "192.0.2.0/24"),
+			header: func(c net.Conn) []byte { return proxyproto.AppendHeader(nil, proxyproto.Version1, src, dst) },
+			expect: func(c net.Conn) []byte { return nil },
+		},
+	}
+	for i, tt := range tests {
+		_, addr := listenGroup(t, tt.group)
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := newRequest(&tt.group.Servers[0])
+		c.Write(append(tt.header(c), request...))
+
+		expect := tt.expect(c)
+		if expect == nil {
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("test %v: expect the connection to be closed, got %v", i, err)
+			}
+			c.Close()
+			continue
+		}
+		rc, err := backend.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(expect)+len(request))
+		rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(rc, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, append(expect, request...)) {
+			t.Errorf("test %v: unexpected bytes received by the target: %q", i, b)
+		}
+		c.Close()
+		rc.Close()
+	}
+}
+
+func TestDispatcher_Metrics(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	g := &config.Group{
+		Name:           fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		AuthFailPolicy: config.AuthFailDrain,
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "chacha20-ietf-poly1305",
+			Password: "password",
+		}},
+	}
+	_, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := newRequest(&g.Servers[0])
+	c.Write(request)
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(rc, make([]byte, len(request)))
+	rc.Write([]byte("response"))
+	io.ReadFull(c, make([]byte, len("response")))
+	if v := metrics.ServerTCPConnections.With(g.Name, "server").Value(); v != 1 {
+		t.Errorf("expect 1 active connection, got %v", v)
+	}
+	c.Close()
+	rc.Close()
+
+	bad, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write(make([]byte, BasicLen))
+	bad.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.GroupDrains.With(g.Name).Value() == 0 || metrics.ServerTCPConnections.With(g.Name, "server").Value() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("metrics not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// listenGroup makes a connection as well
+	if v := metrics.GroupConnections.With(g.Name, "tcp").Value(); v < 2 {
+		t.Errorf("expect at least 2 connections, got %v", v)
+	}
+	if v := metrics.GroupAuthSuccesses.With(g.Name, "tcp").Value(); v != 1 {
+		t.Errorf("expect 1 auth success, got %v", v)
+	}
+	if v := metrics.GroupAuthFailures.With(g.Name, "tcp").Value(); v != 1 {
+		t.Errorf("expect 1 auth failure, got %v", v)
+	}
+	if v := metrics.ServerBytes.With(g.Name, "server", "tcp", "up").Value(); v != uint64(len(request)) {
+		t.Errorf("expect %v bytes up, got %v", len(request), v)
+	}
+	if v := metrics.ServerBytes.With(g.Name, "server", "tcp", "down").Value(); v != uint64(len("response")) {
+		t.Errorf("expect %v bytes down, got %v", len("response"), v)
+	}
+}
+
+func TestDispatcher_KillConn(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	g := &config.Group{
+		Name:           fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		AuthFailPolicy: config.AuthFailDrain,
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "chacha20-ietf-poly1305",
+			Password: "password",
+		}},
+	}
+	_, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := newRequest(&g.Servers[0])
+	c.Write(request)
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	io.ReadFull(rc, make([]byte, len(request)))
+
+	conns := conntrack.Default.List(conntrack.Filter{Group: g.Name})
+	if len(conns) != 1 || conns[0].Server != "server" || conns[0].Client.String() != c.LocalAddr().String() || conns[0].Up() != uint64(len(request)) {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+	if killed := conntrack.Default.Kill(conntrack.Filter{Group: g.Name, Server: "server"}); len(killed) != 1 {
+		t.Fatalf("expect 1 connection killed, got %v", len(killed))
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect EOF on the client side, got %v", err)
+	}
+}
+
+func TestDispatcher_Shutdown(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	g := &config.Group{
+		Name: fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "chacha20-ietf-poly1305",
+			Password: "password",
+		}},
+	}
+	d, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := newRequest(&g.Servers[0])
+	c.Write(request)
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	io.ReadFull(rc, make([]byte, len(request)))
+
+	const timeout = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	ch := make(chan error, 1)
+	go func() {
+		ch <- d.Shutdown(ctx)
+	}()
+
+	// wait for the listener to be closed
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Since(start) > timeout {
+			t.Fatal("the listener should be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the address is free to listen on again while draining
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("the address should be free while draining: %v", err)
+	}
+	l.Close()
+
+	// active connections keep working while draining
+	rc.Write([]byte("response"))
+	c.SetReadDeadline(time.Now().Add(timeout))
+	if _, err = io.ReadFull(c, make([]byte, len("response"))); err != nil {
+		t.Fatalf("the connection should work while draining: %v", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown should return after the timeout")
+	}
+	if time.Since(start) < timeout {
+		t.Fatal("Shutdown should wait for active connections")
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the connection should be force-closed, got %v", err)
+	}
+}
+
+func TestDispatcher_Fallback(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	g := &config.Group{
+		Name: fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		Fallback: &config.FallbackConf{
+			Target:        decoy.Addr().String(),
+			ProxyProtocol: "v1",
+		},
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildFallback()
+	_, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl/7.81.0\r\n\r\n")
+	c.Write(request)
+
+	rc, err := decoy.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	header := proxyproto.AppendHeader(nil, proxyproto.Version1, c.LocalAddr(), c.RemoteAddr())
+	b := make([]byte, len(header)+len(request))
+	rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(rc, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, append(header, request...)) {
+		t.Fatalf("unexpected bytes received by the decoy: %q", b)
+	}
+	rc.Write([]byte("HTTP/1.1 200 OK\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, len("HTTP/1.1 200 OK\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if v := metrics.ServerTCPConnections.With(g.Name, config.FallbackServerName).Value(); v != 1 {
+		t.Errorf("expect 1 active fallback connection, got %v", v)
+	}
+}
+
+func TestDispatcher_Limit(t *testing.T) {
+	g := &config.Group{
+		Name:             fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		AuthFailPolicy:   config.AuthFailDrain,
+		MaxTCPConnsPerIP: 1,
+		Servers: []config.Server{{
+			Target:   "127.0.0.1:1",
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildLimiter()
+	_, addr := listenGroup(t, g)
+	// wait for the readiness check of listenGroup to release its slot
+	for metrics.GroupConnections.With(g.Name, "tcp").Value() == 0 || g.Limiter.Total() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rejections := metrics.GroupLimitRejections.With(g.Name, "tcp", config.LimitIP).Value()
+
+	held, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	// failing to auth does not release the slot while draining
+	held.Write(make([]byte, BasicLen))
+	for g.Limiter.Total() != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the connection over the limit should be closed, got %v", err)
+	}
+	if v := metrics.GroupLimitRejections.With(g.Name, "tcp", config.LimitIP).Value() - rejections; v != 1 {
+		t.Fatalf("expect 1 rejection, got %v", v)
+	}
+}
+
+func TestDispatcher_RateLimit(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	const rate = 100 << 10
+	g := &config.Group{
+		Name: fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		Servers: []config.Server{{
+			Name:              "server",
+			Target:            backend.Addr().String(),
+			Method:            "aes-256-gcm",
+			Password:          "password",
+			DownloadRateLimit: rate,
+		}},
+	}
+	g.BuildShaper()
+	_, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := newRequest(&g.Servers[0])
+	c.Write(request)
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	io.ReadFull(rc, make([]byte, len(request)))
+
+	// a second of burst and 1.5 seconds of shaping
+	const size = rate * 5 / 2
+	start := time.Now()
+	go rc.Write(make([]byte, size))
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 1200*time.Millisecond {
+		t.Fatalf("the download should be shaped, took %v", elapsed)
+	}
+}
+
+func TestDispatcher_Shards(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			c.Close()
+		}
+	}()
+
+	g := &config.Group{
+		Name:           t.Name(),
+		ListenerShards: 4,
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	d, addr := listenGroup(t, g)
+	d.lMutex.Lock()
+	shards := len(d.ls)
+	d.lMutex.Unlock()
+	if shards != 4 {
+		t.Fatalf("expect 4 shards, got %v", shards)
+	}
+
+	// connections failing to auth are relayed to the first server
+	junk := make([]byte, 128)
+	rand.Read(junk)
+	for i := 0; i < 20; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write(junk)
+		defer c.Close()
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v connections relayed", i)
+		}
+	}
+
+	d.Close()
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("shards are not closed")
+	}
+}
+
+func TestDispatcher_Failover(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	g := &config.Group{
+		Name: fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   dead.Addr().String(),
+			Targets:  []string{backend.Addr().String()},
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildTargets()
+	_, addr := listenGroup(t, g)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(newRequest(&g.Servers[0]))
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if v := metrics.TargetDialFailures.With(g.Name, dead.Addr().String(), "tcp").Value(); v != 1 {
+		t.Errorf("expect 1 dial failure of the dead target, got %v", v)
+	}
+	targets := g.Servers[0].TargetList()
+	for i := 0; i < 100 && targets[1].Conns() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if targets[0].Conns() != 0 || targets[1].Conns() != 1 {
+		t.Errorf("unexpected connections of targets: %v %v", targets[0].Conns(), targets[1].Conns())
+	}
+}
+
+func TestDispatcher_ReplayFilter(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	g := &config.Group{
+		Name:                 fmt.Sprint(t.Name(), time.Now().UnixNano()),
+		ReplayFilterCapacity: 100,
+		AuthFailPolicy:       config.AuthFailRST,
+		AuthFailMaxBytes:     1,
+		Servers: []config.Server{{
+			Name:     "server",
+			Target:   backend.Addr().String(),
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildReplayFilter()
+	_, addr := listenGroup(t, g)
+	request := newRequest(&g.Servers[0])
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(request)
+	rc, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err = io.ReadFull(rc, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same handshake again
+	replayed, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	replayed.Write(request)
+	replayed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = replayed.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("the replayed handshake should be rejected, got %v", err)
+	}
+}
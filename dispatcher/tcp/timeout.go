@@ -0,0 +1,150 @@
+package tcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TimeoutIdle      = "idle"
+	TimeoutLifetime  = "lifetime"
+	TimeoutHalfClose = "half-close"
+)
+
+type relayTimeouts struct {
+	idle      time.Duration
+	lifetime  time.Duration
+	halfClose time.Duration
+}
+
+func (t relayTimeouts) enabled() bool {
+	return t.idle > 0 || t.lifetime > 0 || t.halfClose > 0
+}
+
+// watchdog calls close when a relay times out.
+type watchdog struct {
+	timeouts relayTimeouts
+	start    time.Time
+	// lastActive is the unix nano time of the last traffic in either direction
+	lastActive int64
+	halfClosed int32
+	close      func()
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	stopped  bool
+	closedBy string
+}
+
+// newWatchdog returns nil if all timeouts are disabled.
+func newWatchdog(timeouts relayTimeouts, closer func()) *watchdog {
+	if !timeouts.enabled() {
+		return nil
+	}
+	now := time.Now()
+	w := &watchdog{
+		timeouts:   timeouts,
+		start:      now,
+		lastActive: now.UnixNano(),
+		close:      closer,
+	}
+	w.mu.Lock()
+	w.timer = time.AfterFunc(w.next(now), w.check)
+	w.mu.Unlock()
+	return w
+}
+
+// Touch refreshes the idle timeout.
+func (w *watchdog) Touch() {
+	if w != nil {
+		atomic.StoreInt64(&w.lastActive, time.Now().UnixNano())
+	}
+}
+
+// HalfClose switches the idle timeout to the half-close timeout.
+func (w *watchdog) HalfClose() {
+	if w == nil || !atomic.CompareAndSwapInt32(&w.halfClosed, 0, 1) {
+		return
+	}
+	w.Touch()
+	if w.timeouts.halfClose > 0 {
+		w.mu.Lock()
+		if !w.stopped {
+			w.timer.Reset(w.next(time.Now()))
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Stop stops the watchdog and returns the timeout which closed the relay, or "" if none.
+func (w *watchdog) Stop() (closedBy string) {
+	if w == nil {
+		return ""
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	w.timer.Stop()
+	return w.closedBy
+}
+
+func (w *watchdog) idleTimeout() time.Duration {
+	if atomic.LoadInt32(&w.halfClosed) != 0 && w.timeouts.halfClose > 0 {
+		return w.timeouts.halfClose
+	}
+	return w.timeouts.idle
+}
+
+// expired returns the timeout expired at now, or "" if none.
+func (w *watchdog) expired(now time.Time) string {
+	if w.timeouts.lifetime > 0 && now.Sub(w.start) >= w.timeouts.lifetime {
+		return TimeoutLifetime
+	}
+	if idle := w.idleTimeout(); idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&w.lastActive))) >= idle {
+		if atomic.LoadInt32(&w.halfClosed) != 0 && w.timeouts.halfClose > 0 {
+			return TimeoutHalfClose
+		}
+		return TimeoutIdle
+	}
+	return ""
+}
+
+// next returns the duration until the earliest deadline.
+func (w *watchdog) next(now time.Time) time.Duration {
+	var d time.Duration
+	var ok bool
+	if w.timeouts.lifetime > 0 {
+		d, ok = w.start.Add(w.timeouts.lifetime).Sub(now), true
+	}
+	if idle := w.idleTimeout(); idle > 0 {
+		if i := time.Unix(0, atomic.LoadInt64(&w.lastActive)).Add(idle).Sub(now); !ok || i < d {
+			d, ok = i, true
+		}
+	}
+	if !ok {
+		// no deadline yet, e.g. waiting for a half-close
+		return time.Duration(1<<63 - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (w *watchdog) check() {
+	now := time.Now()
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	if w.closedBy = w.expired(now); w.closedBy == "" {
+		w.timer.Reset(w.next(now))
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+	w.close()
+}
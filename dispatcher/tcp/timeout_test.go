@@ -0,0 +1,142 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
+	"github.com/Qv2ray/mmp-go/metrics"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// startRelay relays between a client and a target, and returns the client end, the target end and the result.
+func startRelay(t *testing.T, timeouts relayTimeouts) (client, target *net.TCPConn, result chan string) {
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	go io.Copy(io.Discard, target)
+	result = make(chan string, 1)
+	go func() {
+		var c metrics.Counter
+		closedBy, _ := relay(lc, rc, &c, &c, new(conntrack.Conn), nil, nil, timeouts)
+		result <- closedBy
+	}()
+	return client, target, result
+}
+
+func waitRelay(t *testing.T, result chan string) (closedBy string) {
+	select {
+	case closedBy = <-result:
+		return closedBy
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay does not end")
+		return ""
+	}
+}
+
+func TestRelay_IdleTimeout(t *testing.T) {
+	const idle = 300 * time.Millisecond
+	client, _, result := startRelay(t, relayTimeouts{idle: idle})
+	start := time.Now()
+	// traffic refreshes the idle timeout
+	for i := 0; i < 5; i++ {
+		client.Write([]byte("ping"))
+		time.Sleep(idle / 3)
+	}
+	if closedBy := waitRelay(t, result); closedBy != TimeoutIdle {
+		t.Fatalf("expect closed by %v, got %q", TimeoutIdle, closedBy)
+	}
+	if elapsed := time.Since(start); elapsed < 2*idle {
+		t.Fatalf("the idle timeout should be refreshed by traffic, closed after %v", elapsed)
+	}
+}
+
+func TestRelay_IdleTimeoutWithRateLimit(t *testing.T) {
+	const rate = 50 << 10
+	shaper := config.NewShaper()
+	server := &config.Server{Name: "server", DownloadRateLimit: rate}
+	shaper.Update(&config.Group{Servers: []config.Server{*server}})
+	flow := shaper.Acquire(server, net.IPv4(127, 0, 0, 1))
+	defer flow.Release()
+
+	client, lc := tcpPair(t)
+	rc, target := tcpPair(t)
+	go io.Copy(io.Discard, target)
+	result := make(chan string, 1)
+	go func() {
+		var c metrics.Counter
+		closedBy, _ := relay(lc, rc, &c, &c, new(conntrack.Conn), nil, flow, relayTimeouts{idle: 300 * time.Millisecond})
+		result <- closedBy
+	}()
+
+	// a second of burst and two seconds of shaping, far longer than the idle timeout
+	const size = rate * 3
+	go target.Write(make([]byte, size))
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(client, make([]byte, size)); err != nil {
+		t.Fatalf("a shaped relay should not be closed as idle: %v", err)
+	}
+	if closedBy := waitRelay(t, result); closedBy != TimeoutIdle {
+		t.Fatalf("expect closed by %v after the transfer, got %q", TimeoutIdle, closedBy)
+	}
+}
+
+func TestRelay_Lifetime(t *testing.T) {
+	const lifetime = 300 * time.Millisecond
+	client, _, result := startRelay(t, relayTimeouts{idle: time.Minute, lifetime: lifetime})
+	start := time.Now()
+	go func() {
+		for {
+			if _, err := client.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if closedBy := waitRelay(t, result); closedBy != TimeoutLifetime {
+		t.Fatalf("expect closed by %v, got %q", TimeoutLifetime, closedBy)
+	}
+	if elapsed := time.Since(start); elapsed < lifetime || elapsed > 3*lifetime {
+		t.Fatalf("expect closed after %v, got %v", lifetime, elapsed)
+	}
+}
+
+func TestRelay_HalfCloseTimeout(t *testing.T) {
+	client, _, result := startRelay(t, relayTimeouts{idle: time.Minute, halfClose: 200 * time.Millisecond})
+	client.CloseWrite()
+	if closedBy := waitRelay(t, result); closedBy != TimeoutHalfClose {
+		t.Fatalf("expect closed by %v, got %q", TimeoutHalfClose, closedBy)
+	}
+}
+
+func TestRelay_NoTimeout(t *testing.T) {
+	client, target, result := startRelay(t, relayTimeouts{halfClose: time.Minute})
+	client.CloseWrite()
+	target.CloseWrite()
+	if closedBy := waitRelay(t, result); closedBy != "" {
+		t.Fatalf("expect closed normally, got %q", closedBy)
+	}
+}
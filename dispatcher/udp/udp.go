@@ -1,17 +1,28 @@
 package udp
 
 import (
+	"context"
+	"crypto/aes"
+	stdcipher "crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/Qv2ray/mmp-go/cipher"
 	"github.com/Qv2ray/mmp-go/config"
 	"github.com/Qv2ray/mmp-go/dispatcher"
 	"github.com/Qv2ray/mmp-go/dispatcher/infra"
+	"github.com/Qv2ray/mmp-go/infra/activation"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
 	"github.com/Qv2ray/mmp-go/infra/pool"
+	"github.com/Qv2ray/mmp-go/infra/proxyproto"
+	"github.com/Qv2ray/mmp-go/metrics"
 	"golang.org/x/net/dns/dnsmessage"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -22,36 +33,135 @@ const (
 	DnsQueryTimeout   = 17 * time.Second // RFC 5452
 )
 
-var AuthFailedErr = fmt.Errorf("auth failed")
+var (
+	AuthFailedErr = fmt.Errorf("auth failed")
+	DrainingErr   = fmt.Errorf("draining")
+	LimitedErr    = fmt.Errorf("limited")
+)
 
 func init() {
 	dispatcher.Register("udp", New)
 }
 
 type UDP struct {
-	gMutex sync.RWMutex
-	group  *config.Group
-	c      *net.UDPConn
-	nm     *UDPConnMapping
+	gMutex   sync.RWMutex
+	group    *config.Group
+	addr     config.ListenAddr
+	cMutex   sync.Mutex
+	cs       []*net.UDPConn
+	releases []func() // give the inherited sockets of cs back to be taken again
+	closed   bool
+	nm       *UDPConnMapping
+	tracker  infra.Tracker
+	draining int32
+	// handedOver is set if the socket is handed to another process, which should read new packets from it
+	handedOver int32
 }
 
-func New(g *config.Group) (d dispatcher.Dispatcher) {
-	return &UDP{group: g, nm: NewUDPConnMapping()}
+func New(g *config.Group, addr config.ListenAddr) (d dispatcher.Dispatcher) {
+	return &UDP{group: g, addr: addr, nm: NewUDPConnMapping()}
+}
+
+// Bind listens on the address without reading yet, so that errors show up before serving.
+// Listen calls it unless it has been called.
+func (d *UDP) Bind() (err error) {
+	d.gMutex.RLock()
+	shards := d.group.Shards()
+	d.gMutex.RUnlock()
+	var inherited syscall.Conn
+	for i := 0; i < shards; i++ {
+		c, release, err := d.inherit()
+		if err == nil && c == nil {
+			if inherited != nil && !infra.ReusePortEnabled(inherited) {
+				// listening on more would fail with EADDRINUSE
+				log.Printf("[warning] [udp] listen on %v with %d of %d shards: more shards need SO_REUSEPORT on the inherited socket, e.g. ReusePort=yes in the systemd socket unit, or a restart instead of an upgrade\n", d.addr, i, shards)
+				break
+			}
+			c, release, err = d.listen(shards > 1)
+		} else if err == nil && i == 0 {
+			inherited = c
+		}
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			log.Printf("[warning] [udp] listen on %v with %d of %d shards: %v\n", d.addr, i, shards, err)
+			break
+		}
+		d.cMutex.Lock()
+		if d.closed {
+			d.cMutex.Unlock()
+			c.Close()
+			release()
+			break
+		}
+		d.cs = append(d.cs, c)
+		d.releases = append(d.releases, release)
+		d.cMutex.Unlock()
+	}
+	return nil
 }
 
 func (d *UDP) Listen() (err error) {
-	d.c, err = net.ListenUDP("udp", &net.UDPAddr{Port: d.group.Port})
+	d.cMutex.Lock()
+	bound := len(d.cs) > 0
+	d.cMutex.Unlock()
+	if !bound {
+		if err = d.Bind(); err != nil {
+			return err
+		}
+	}
+	d.cMutex.Lock()
+	cs := append([]*net.UDPConn(nil), d.cs...)
+	d.cMutex.Unlock()
+	var wg sync.WaitGroup
+	for _, c := range cs {
+		wg.Add(1)
+		go func(c *net.UDPConn) {
+			defer wg.Done()
+			d.serve(c)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
+// inherit takes a socket passed by systemd or the old process, or returns nil if none.
+// release should be called after closing c.
+func (d *UDP) inherit() (c *net.UDPConn, release func(), err error) {
+	if c, release, err = activation.TakePacketConn(d.group.MatchSocket("udp", d.addr)); c != nil {
+		log.Printf("[udp] listen on %v inherited\n", d.addr)
+	}
+	return c, release, err
+}
+
+// listen listens on the address with SO_REUSEPORT if reusePort.
+func (d *UDP) listen(reusePort bool) (c *net.UDPConn, release func(), err error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = infra.ReusePort
+	}
+	pc, err := lc.ListenPacket(context.Background(), d.addr.Network("udp"), d.addr.String())
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	defer d.c.Close()
-	log.Printf("[udp] listen on :%v\n", d.group.Port)
+	log.Printf("[udp] listen on %v\n", d.addr)
+	return pc.(*net.UDPConn), func() {}, nil
+}
+
+// serve reads packets from c until it is closed, or stops reading after handing over.
+// c is closed by Close or Unlisten rather than here, because it is needed to relay packets of existing sessions.
+func (d *UDP) serve(c *net.UDPConn) {
 	var buf [MTU]byte
 	for {
-		n, laddr, err := d.c.ReadFrom(buf[:])
+		n, laddr, err := c.ReadFrom(buf[:])
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return
+			}
+			if atomic.LoadInt32(&d.draining) != 0 && atomic.LoadInt32(&d.handedOver) != 0 {
+				// the socket is closed after draining
+				return
 			}
 			log.Printf("[error] ReadFrom: %v", err)
 			continue
@@ -59,7 +169,7 @@ func (d *UDP) Listen() (err error) {
 		data := pool.Get(n)
 		copy(data, buf[:n])
 		go func() {
-			err := d.handleConn(laddr, data, n)
+			err := d.handleConn(c, laddr, data, n)
 			if err != nil {
 				log.Println(err)
 			}
@@ -74,20 +184,49 @@ func (d *UDP) UpdateGroup(group *config.Group) {
 	d.group = group
 }
 
-func (d *UDP) handleConn(laddr net.Addr, data []byte, n int) (err error) {
+func (d *UDP) handleConn(c *net.UDPConn, laddr net.Addr, data []byte, n int) (err error) {
 	// get conn or dial and relay
-	rc, err := d.GetOrBuildUCPConn(laddr, data[:n])
+	rc, isNew, err := d.GetOrBuildUCPConn(c, laddr, data[:n])
 	if err != nil {
-		if err == AuthFailedErr {
+		if err == AuthFailedErr || err == DrainingErr || err == LimitedErr {
 			return nil
 		}
 		return fmt.Errorf("[udp] handleConn dial target error: %w", err)
 	}
+	if !isNew && d.isReplayedPacket(rc, data[:n]) {
+		// the first packet has been checked when building the session
+		metrics.GroupReplays.With(rc.entry.Group, "udp").Inc()
+		return nil
+	}
+
+	packet := data[:n]
+	if rc.identity != nil {
+		var ok bool
+		if packet, ok = rc.identity.StripIdentityHeader(packet); !ok {
+			return nil
+		}
+	}
+
+	if rc.proxyHeader != nil {
+		b := pool.Get(len(rc.proxyHeader) + len(packet))
+		defer pool.Put(b)
+		copy(b, rc.proxyHeader)
+		copy(b[len(rc.proxyHeader):], packet)
+		packet = b
+	}
+
+	if !rc.flow.AllowUp(n) {
+		// drop packets exceeding the rate limits
+		return nil
+	}
 
 	// send packet
-	if _, err = rc.Write(data[:n]); err != nil {
+	if _, err = rc.Write(packet); err != nil {
 		return fmt.Errorf("[udp] handleConn write error: %w", err)
 	}
+	rc.up.Add(uint64(n))
+	rc.entry.AddUp(uint64(n))
+	rc.server.AddUsage(uint64(n))
 	return nil
 }
 
@@ -107,57 +246,143 @@ func selectTimeout(packet []byte) time.Duration {
 }
 
 // connTimeout is the timeout of connection to build if not exists
-func (d *UDP) GetOrBuildUCPConn(laddr net.Addr, data []byte) (rc *net.UDPConn, err error) {
+// GetOrBuildUCPConn returns the session of laddr, or builds one replying by c. isNew is true if data is the first packet of it.
+func (d *UDP) GetOrBuildUCPConn(c *net.UDPConn, laddr net.Addr, data []byte) (rc *UDPConn, isNew bool, err error) {
 	socketIdent := laddr.String()
 	d.nm.Lock()
 	var conn *UDPConn
 	var ok bool
 	if conn, ok = d.nm.Get(socketIdent); !ok {
+		if atomic.LoadInt32(&d.draining) != 0 {
+			// only existing sessions are served while draining
+			d.nm.Unlock()
+			return nil, false, DrainingErr
+		}
+		groupName := d.group.Name
+		release := func() {}
+		if d.group.Limiter != nil {
+			var limit string
+			if release, limit = d.group.Limiter.Acquire(infra.AddrIP(laddr), "udp"); release == nil {
+				d.nm.Unlock()
+				log.Printf("[udp] %s <-x-> %s rejected by the %s limit", laddr, c.LocalAddr(), limit)
+				metrics.GroupLimitRejections.With(groupName, "udp", limit).Inc()
+				return nil, false, LimitedErr
+			}
+		}
 		// not exist such socket mapping, build one
 		d.nm.Insert(socketIdent, nil)
 		d.nm.Unlock()
-
-		// get user's context (preference)
-		d.gMutex.RLock() // avoid insert old servers to the new userContextPool
-		userContext := d.group.UserContextPool.GetOrInsert(laddr, d.group.Servers)
-		d.gMutex.RUnlock()
+		metrics.GroupConnections.With(groupName, "udp").Inc()
 
 		buf := pool.Get(len(data))
 		defer pool.Put(buf)
-		// auth every server
-		server, content := d.Auth(buf, data, userContext)
+		// look up the user by the identity header
+		var identity *identitySession
+		server, content := d.AuthIdentity(buf, data)
+		if server != nil {
+			d.gMutex.RLock()
+			identity, err = newIdentitySession(d.group.IdentityKey, server.MasterKey)
+			d.gMutex.RUnlock()
+			if err != nil {
+				server = nil
+			}
+		} else {
+			// get user's context (preference)
+			d.gMutex.RLock() // avoid insert old servers to the new userContextPool
+			userContext := d.group.UserContextPool.GetOrInsert(laddr, d.group.Servers)
+			d.gMutex.RUnlock()
+
+			// auth every server
+			server, content = d.Auth(buf, data, userContext)
+		}
+		var headerBlock stdcipher.Block
+		if server != nil {
+			headerBlock = separateHeaderBlock(server, identity)
+		}
+		if server != nil && d.group.ReplayFilter != nil && d.isReplay(data, server, headerBlock) {
+			log.Printf("[udp] replayed packet from %s, rejected", laddr)
+			metrics.GroupReplays.With(groupName, "udp").Inc()
+			server = nil
+		}
 		if server == nil {
-			d.nm.Lock()
-			// remove socketIdent to avoid goroutine leak
-			if conn, ok = d.nm.Get(socketIdent); ok {
-				select {
-				case <-conn.Establishing:
-				default:
-					d.nm.Remove(socketIdent)
+			metrics.GroupAuthFailures.With(groupName, "udp").Inc()
+			if server = d.group.UDPFallbackServer(); server == nil {
+				d.nm.Lock()
+				// remove socketIdent to avoid goroutine leak
+				if conn, ok = d.nm.Get(socketIdent); ok {
+					select {
+					case <-conn.Establishing:
+					default:
+						d.nm.Remove(socketIdent)
+					}
 				}
+				d.nm.Unlock()
+				release()
+				return nil, false, AuthFailedErr
 			}
-			d.nm.Unlock()
-			return nil, AuthFailedErr
+			// forward the packets as they are to the decoy target
+			metrics.GroupFallbacks.With(groupName).Inc()
+			identity, content, headerBlock = nil, nil, nil
+		} else {
+			metrics.GroupAuthSuccesses.With(groupName, "udp").Inc()
 		}
 
 		// dial
-		rconn, err := net.Dial("udp", server.Target)
+		dialer := d.group.Dialer(server, "udp")
+		rconn, target, err := infra.DialTargets("udp", groupName, server.PickTargets(infra.AddrIP(laddr)), func(addr string) (net.Conn, error) {
+			return d.group.DialTarget(server, "udp", addr, dialer.DialContext)
+		})
 		if err != nil {
 			d.nm.Lock()
 			d.nm.Remove(socketIdent) // close channel to inform that establishment ends
 			d.nm.Unlock()
-			return nil, fmt.Errorf("GetOrBuildUCPConn dial error: %w", err)
+			release()
+			return nil, false, fmt.Errorf("GetOrBuildUCPConn dial error: %w", err)
 		}
-		rc = rconn.(*net.UDPConn)
 		d.nm.Lock()
 		d.nm.Remove(socketIdent) // close channel to inform that establishment ends
-		conn = d.nm.Insert(socketIdent, rc)
+		conn = d.nm.Insert(socketIdent, rconn.(*net.UDPConn))
 		conn.timeout = selectTimeout(content)
+		conn.identity = identity
+		conn.headerBlock = headerBlock
+		if headerBlock != nil {
+			conn.sessionID, _, _ = separateHeader(data, server, headerBlock)
+		}
+		conn.server = server
+		conn.up = metrics.ServerBytes.With(groupName, server.Name, "udp", "up")
+		down := metrics.ServerBytes.With(groupName, server.Name, "udp", "down")
+		if d.group.ProxyProtocolVersion(server) != 0 {
+			conn.proxyHeader = proxyproto.AppendHeader(nil, proxyproto.Version2, laddr, c.LocalAddr())
+		}
+		conn.flow = d.group.Shaper.Acquire(server, infra.AddrIP(laddr))
+		conn.entry = conntrack.Default.Add(&conntrack.Conn{
+			Protocol: "udp",
+			Client:   laddr,
+			Group:    groupName,
+			Server:   server.Name,
+			Target:   target.Addr,
+		}, func() {
+			// the relay ends and removes the mapping
+			rconn.Close()
+		})
 		d.nm.Unlock()
+		rc, isNew = conn, true
 		// relay
-		log.Printf("[udp] %s <-> %s <-> %s", laddr.String(), d.c.LocalAddr(), rc.RemoteAddr())
+		log.Printf("[udp] %s <-> %s <-> %s", laddr.String(), c.LocalAddr(), rc.RemoteAddr())
+		sessions := metrics.ServerUDPSessions.With(groupName, server.Name)
+		sessions.Inc()
+		done := d.tracker.Add(func() {
+			rconn.Close()
+		})
+		releaseTarget := target.Acquire()
 		go func() {
-			_ = relay(d.c, laddr, rc, conn.timeout)
+			defer done()
+			defer release()
+			defer releaseTarget()
+			_ = relay(c, laddr, rc.UDPConn, conn.timeout, down, conn.entry, conn.flow, server)
+			conn.flow.Release()
+			conntrack.Default.Remove(conn.entry)
+			sessions.Dec()
 			d.nm.Lock()
 			d.nm.Remove(socketIdent)
 			d.nm.Unlock()
@@ -168,18 +393,18 @@ func (d *UDP) GetOrBuildUCPConn(laddr net.Addr, data []byte) (rc *net.UDPConn, e
 		<-conn.Establishing
 		if conn.UDPConn == nil {
 			// establishment ended and retrieve the result
-			return d.GetOrBuildUCPConn(laddr, data)
+			return d.GetOrBuildUCPConn(c, laddr, data)
 		} else {
 			// establishment succeeded
-			rc = conn.UDPConn
+			rc = conn
 		}
 	}
 	// countdown
 	_ = conn.UDPConn.SetReadDeadline(time.Now().Add(conn.timeout))
-	return rc, nil
+	return rc, isNew, nil
 }
 
-func relay(dst *net.UDPConn, laddr net.Addr, src *net.UDPConn, timeout time.Duration) (err error) {
+func relay(dst *net.UDPConn, laddr net.Addr, src *net.UDPConn, timeout time.Duration, down *metrics.Counter, entry *conntrack.Conn, flow *config.Flow, server *config.Server) (err error) {
 	var n int
 	buf := pool.Get(MTUTrie.GetMTU(src.LocalAddr().(*net.UDPAddr).IP))
 	defer pool.Put(buf)
@@ -189,31 +414,224 @@ func relay(dst *net.UDPConn, laddr net.Addr, src *net.UDPConn, timeout time.Dura
 		if err != nil {
 			return
 		}
+		if !flow.AllowDown(n) {
+			// drop packets exceeding the rate limits
+			continue
+		}
 		_ = dst.SetWriteDeadline(time.Now().Add(DefaultNatTimeout)) // should keep consistent
 		_, err = dst.WriteTo(buf[:n], laddr)
 		if err != nil {
 			return
 		}
+		down.Add(uint64(n))
+		entry.AddDown(uint64(n))
+		server.AddUsage(uint64(n))
+	}
+}
+
+// separateHeaderBlock returns the block cipher of the separate headers of the SIP022 packets to the server,
+// or nil if the method does not encrypt them by a block cipher.
+func separateHeaderBlock(server *config.Server, identity *identitySession) stdcipher.Block {
+	if identity != nil {
+		return identity.identityBlock
+	}
+	conf := cipher.CiphersConf[server.Method]
+	if !conf.SIP022 || conf.NewBlockCipher == nil {
+		return nil
+	}
+	block, err := conf.NewBlockCipher(server.MasterKey)
+	if err != nil {
+		return nil
+	}
+	return block
+}
+
+// isReplay checks the first packet of a session by the replay filter:
+// SIP022 packets by their session and packet IDs, which are unique per packet, and others by their salts.
+func (d *UDP) isReplay(data []byte, server *config.Server, headerBlock stdcipher.Block) bool {
+	conf := cipher.CiphersConf[server.Method]
+	if !conf.SIP022 {
+		return d.group.ReplayFilter.IsReplay(data[:conf.SaltLen])
+	}
+	sessionID, packetID, ok := separateHeader(data, server, headerBlock)
+	return ok && d.group.ReplayFilter.IsReplayPacket(sessionID, packetID)
+}
+
+// separateHeader decrypts the session and packet IDs of a SIP022 packet.
+func separateHeader(data []byte, server *config.Server, headerBlock stdcipher.Block) (sessionID uint64, packetID uint64, ok bool) {
+	var header [cipher.UDPSeparateHeaderLen]byte
+	conf := cipher.CiphersConf[server.Method]
+	if headerBlock != nil {
+		if len(data) < cipher.UDPSeparateHeaderLen {
+			return 0, 0, false
+		}
+		headerBlock.Decrypt(header[:], data[:cipher.UDPSeparateHeaderLen])
+	} else if !conf.DecryptUDPSeparateHeader(header[:], server.MasterKey, data) {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(header[:8]), binary.BigEndian.Uint64(header[8:]), true
+}
+
+// isReplayedPacket checks a later packet of a SIP022 session by the replay filter.
+// Packets of 2022-blake3-chacha20-poly1305 are not checked, which would take decrypting them as a whole.
+func (d *UDP) isReplayedPacket(rc *UDPConn, packet []byte) bool {
+	d.gMutex.RLock()
+	filter := d.group.ReplayFilter
+	d.gMutex.RUnlock()
+	if filter == nil || rc.headerBlock == nil {
+		return false
+	}
+	sessionID, packetID, ok := separateHeader(packet, rc.server, rc.headerBlock)
+	if !ok || sessionID != rc.sessionID {
+		// the packet is not authenticated, so only the IDs of the session authenticated are remembered,
+		// leaving others to the target
+		return false
 	}
+	return filter.IsReplayPacket(sessionID, packetID)
 }
 
 func (d *UDP) Auth(buf []byte, data []byte, userContext *config.UserContext) (hit *config.Server, content []byte) {
 	if len(data) < BasicLen {
 		return nil, nil
 	}
-	return userContext.Auth(func(server *config.Server) ([]byte, bool) {
+	d.gMutex.RLock()
+	workers := d.group.AuthWorkers()
+	groupName := d.group.Name
+	d.gMutex.RUnlock()
+	var depth int32
+	hit, content = userContext.Auth(buf, workers, func(buf []byte, server *config.Server) ([]byte, bool) {
+		atomic.AddInt32(&depth, 1)
 		return probe(buf, data, server)
 	})
+	if hit != nil {
+		metrics.AuthProbeDepth.With(groupName, "udp").Observe(float64(atomic.LoadInt32(&depth)))
+	}
+	return hit, content
+}
+
+// AuthIdentity looks up the server by the SIP022 identity header of the packet.
+func (d *UDP) AuthIdentity(buf []byte, data []byte) (hit *config.Server, content []byte) {
+	d.gMutex.RLock()
+	group := d.group
+	d.gMutex.RUnlock()
+	if group.Identities == nil {
+		return nil, nil
+	}
+	//[separate header][identity header][encrypted body][tag]
+	if len(data) < cipher.UDPSeparateHeaderLen+cipher.IdentityHeaderLen {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(group.IdentityKey)
+	if err != nil {
+		return nil, nil
+	}
+	var header [cipher.UDPSeparateHeaderLen]byte
+	block.Decrypt(header[:], data[:cipher.UDPSeparateHeaderLen])
+	h := cipher.DecryptUDPIdentityHeader(block, header[:], data[cipher.UDPSeparateHeaderLen:])
+	i, ok := group.Identities[h]
+	if !ok {
+		return nil, nil
+	}
+	server := &group.Servers[i]
+	if !server.Available() {
+		return nil, nil
+	}
+	conf := cipher.CiphersConf[server.Method]
+	if content, ok := conf.VerifyUDPBody(buf, server.MasterKey, header[:], data[cipher.UDPSeparateHeaderLen+cipher.IdentityHeaderLen:]); ok {
+		return server, content
+	}
+	return nil, nil
+}
+
+// closeConns closes all shards.
+func (d *UDP) closeConns() (err error) {
+	d.cMutex.Lock()
+	defer d.cMutex.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	for i, c := range d.cs {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+		d.releases[i]()
+	}
+	return err
 }
 
 func (d *UDP) Close() (err error) {
-	log.Printf("[udp] closed :%v\n", d.group.Port)
-	return d.c.Close()
+	log.Printf("[udp] closed %v\n", d.addr)
+	return d.closeConns()
+}
+
+// Unlisten closes the sockets at once, so that the address is free to listen on again.
+// Sessions cannot reply without the sockets, so they should be force-closed then.
+// Sockets handed over to another process stay open and are only not read from any more.
+func (d *UDP) Unlisten() (err error) {
+	if atomic.LoadInt32(&d.handedOver) == 0 {
+		return d.closeConns()
+	}
+	// leave all packets to the other process
+	d.cMutex.Lock()
+	defer d.cMutex.Unlock()
+	for _, c := range d.cs {
+		_ = c.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+func (d *UDP) Files() (files []*os.File, err error) {
+	d.cMutex.Lock()
+	defer d.cMutex.Unlock()
+	for _, c := range d.cs {
+		f, err := c.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (d *UDP) HandOver() {
+	atomic.StoreInt32(&d.handedOver, 1)
+}
+
+// Shutdown stops building new sessions and waits for the active ones to end, which keep relaying by the sockets meanwhile.
+// If the sockets have been closed by Unlisten, the sessions are force-closed at once.
+func (d *UDP) Shutdown(ctx context.Context) (err error) {
+	log.Printf("[udp] draining %v, %d active sessions\n", d.addr, d.tracker.Len())
+	atomic.StoreInt32(&d.draining, 1)
+	if atomic.LoadInt32(&d.handedOver) != 0 {
+		// leave new packets to the other process
+		err = d.Unlisten()
+	}
+	d.cMutex.Lock()
+	closed := d.closed
+	d.cMutex.Unlock()
+	if closed {
+		// the sessions have no socket to reply by any more
+		d.tracker.Close()
+	} else if e := d.tracker.Drain(ctx); e != nil {
+		log.Printf("[udp] drain timeout %v, force-closed remaining sessions\n", d.addr)
+	}
+	log.Printf("[udp] closed %v\n", d.addr)
+	if e := d.closeConns(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
 func probe(buf []byte, data []byte, server *config.Server) ([]byte, bool) {
-	//[salt][encrypted payload][tag]
 	conf := cipher.CiphersConf[server.Method]
+	if conf.SIP022 {
+		return conf.VerifyUDPPacket(buf, server.MasterKey, data)
+	}
+	//[salt][encrypted payload][tag]
 	if len(data) < conf.SaltLen+conf.TagLen {
 		return nil, false
 	}
@@ -1,17 +1,73 @@
 package udp
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"net"
 	"sync"
 	"time"
+
+	mcipher "github.com/Qv2ray/mmp-go/cipher"
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/infra/conntrack"
+	"github.com/Qv2ray/mmp-go/metrics"
 )
 
 type UDPConn struct {
 	Establishing chan struct{}
 	timeout      time.Duration
+	identity     *identitySession
+	headerBlock  cipher.Block // decrypts the separate headers of SIP022 packets for the replay filter
+	sessionID    uint64       // the SIP022 session authenticated by the first packet
+	proxyHeader  []byte
+	server       *config.Server
+	up           *metrics.Counter
+	entry        *conntrack.Conn
+	flow         *config.Flow
 	*net.UDPConn
 }
 
+// identitySession rewrites packets with SIP022 identity headers to packets the target can understand.
+type identitySession struct {
+	identityBlock cipher.Block
+	userBlock     cipher.Block
+	hash          mcipher.PSKHash
+}
+
+func newIdentitySession(identityKey []byte, userKey []byte) (*identitySession, error) {
+	identityBlock, err := aes.NewCipher(identityKey)
+	if err != nil {
+		return nil, err
+	}
+	userBlock, err := aes.NewCipher(userKey)
+	if err != nil {
+		return nil, err
+	}
+	return &identitySession{
+		identityBlock: identityBlock,
+		userBlock:     userBlock,
+		hash:          mcipher.NewPSKHash(userKey),
+	}, nil
+}
+
+// StripIdentityHeader removes the identity header of the packet and re-encrypts the separate header with the user PSK.
+// It returns false if the packet does not belong to the user.
+func (s *identitySession) StripIdentityHeader(packet []byte) ([]byte, bool) {
+	//[separate header][identity header][encrypted body][tag]
+	const headerLen = mcipher.UDPSeparateHeaderLen + mcipher.IdentityHeaderLen
+	if len(packet) < headerLen {
+		return nil, false
+	}
+	var header [mcipher.UDPSeparateHeaderLen]byte
+	s.identityBlock.Decrypt(header[:], packet[:mcipher.UDPSeparateHeaderLen])
+	if mcipher.DecryptUDPIdentityHeader(s.identityBlock, header[:], packet[mcipher.UDPSeparateHeaderLen:]) != s.hash {
+		return nil, false
+	}
+	packet = packet[mcipher.IdentityHeaderLen:]
+	s.userBlock.Encrypt(packet[:mcipher.UDPSeparateHeaderLen], header[:])
+	return packet, true
+}
+
 func NewUDPConn(conn *net.UDPConn) *UDPConn {
 	c := &UDPConn{
 		UDPConn:      conn,
@@ -2,7 +2,10 @@ package udp
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/binary"
 	"github.com/Qv2ray/mmp-go/cipher"
 	"github.com/Qv2ray/mmp-go/config"
@@ -10,6 +13,7 @@ import (
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 )
 
 func BenchmarkDispatcher_Auth(b *testing.B) {
@@ -28,7 +32,7 @@ func BenchmarkDispatcher_Auth(b *testing.B) {
 	g.BuildUserContextPool(10)
 	var buf [65535]byte
 	var data [65535]byte
-	var d = New(g)
+	var d = New(g, config.ListenAddr{Port: g.Port})
 	addr, _ := net.ResolveIPAddr("udp", "127.0.0.1:50000")
 	for i := 0; i < b.N; i++ {
 		d.Auth(buf[:], data[:], g.UserContextPool.GetOrInsert(addr, g.Servers))
@@ -49,7 +53,7 @@ func TestDispatcher_Auth(t *testing.T) {
 	}}
 	g.BuildMasterKeys()
 	g.BuildUserContextPool(10)
-	var d = New(g)
+	var d = New(g, config.ListenAddr{Port: g.Port})
 
 	type test struct {
 		data     []byte
@@ -124,3 +128,346 @@ func TestDispatcher_Auth(t *testing.T) {
 		}
 	}
 }
+
+func seal2022(t *testing.T, method string, psk []byte, timestamp time.Time, payload []byte) []byte {
+	conf := cipher.CiphersConf[method]
+	var header [cipher.UDPSeparateHeaderLen]byte
+	rand.Read(header[:8])
+	binary.BigEndian.PutUint64(header[8:], 1)
+
+	body := make([]byte, cipher.UDPMainHeaderLen, cipher.UDPMainHeaderLen+len(payload))
+	body[0] = cipher.HeaderTypeClient
+	binary.BigEndian.PutUint64(body[1:], uint64(timestamp.Unix()))
+	body = append(body, payload...)
+
+	if conf.NewBlockCipher != nil {
+		sk := make([]byte, conf.KeyLen)
+		conf.DeriveSubKey(sk, psk, header[:8])
+		aead, err := conf.NewCipher(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := aead.Seal(nil, header[4:16], body, nil)
+		block, _ := conf.NewBlockCipher(psk)
+		block.Encrypt(header[:], header[:])
+		return bytes.Join([][]byte{header[:], packet}, nil)
+	}
+	aead, err := conf.NewPacketCipher(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [cipher.XNonceLen]byte
+	rand.Read(nonce[:])
+	packet := aead.Seal(nil, nonce[:], bytes.Join([][]byte{header[:], body}, nil), nil)
+	return bytes.Join([][]byte{nonce[:], packet}, nil)
+}
+
+func TestDispatcher_Auth2022(t *testing.T) {
+	for _, method := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305"} {
+		conf := cipher.CiphersConf[method]
+		psk := make([]byte, conf.KeyLen)
+		rand.Read(psk)
+		g := new(config.Group)
+		g.Servers = []config.Server{{
+			Target:   "127.0.0.1:1080",
+			Method:   method,
+			Password: base64.StdEncoding.EncodeToString(psk),
+		}}
+		g.ReplayFilterCapacity = 100
+		g.BuildMasterKeys()
+		g.BuildUserContextPool(10)
+		g.BuildReplayFilter()
+		d := New(g, config.ListenAddr{Port: g.Port}).(*UDP)
+
+		addr := []byte{cipher.ATypeIPv4, 127, 0, 0, 1, 0, 53}
+		var buf [65535]byte
+		laddr, _ := net.ResolveIPAddr("udp", "127.0.0.1:50000")
+
+		data := seal2022(t, method, psk, time.Now(), addr)
+		hit, content := d.Auth(buf[:], data, g.UserContextPool.GetOrInsert(laddr, g.Servers))
+		if hit == nil || !bytes.Equal(content, addr) {
+			t.Fatalf("%v: failed to auth a valid packet", method)
+		}
+		block := separateHeaderBlock(hit, nil)
+		if d.isReplay(data, hit, block) || !d.isReplay(data, hit, block) {
+			t.Errorf("%v: the replay filter should reject the packet ID seen before", method)
+		}
+		if block != nil {
+			rc := &UDPConn{headerBlock: block, server: hit}
+			rc.sessionID, _, _ = separateHeader(data, hit, block)
+			if !d.isReplayedPacket(rc, data) {
+				t.Errorf("%v: a later packet of the session should be checked", method)
+			}
+			// the packets of other sessions are not authenticated, so they are not remembered
+			other := seal2022(t, method, psk, time.Now(), addr)
+			if d.isReplayedPacket(rc, other) || d.isReplayedPacket(rc, other) {
+				t.Errorf("%v: the packet of another session should not be checked", method)
+			}
+		}
+
+		data = seal2022(t, method, psk, time.Now().Add(-time.Minute), addr)
+		if hit, _ := d.Auth(buf[:], data, g.UserContextPool.GetOrInsert(laddr, g.Servers)); hit != nil {
+			t.Errorf("%v: packet with an expired timestamp passed auth", method)
+		}
+
+		data[len(data)-1] ^= 1
+		if hit, _ := d.Auth(buf[:], data, g.UserContextPool.GetOrInsert(laddr, g.Servers)); hit != nil {
+			t.Errorf("%v: tampered packet passed auth", method)
+		}
+	}
+}
+
+func TestDispatcher_AuthIdentity(t *testing.T) {
+	const method = "2022-blake3-aes-128-gcm"
+	conf := cipher.CiphersConf[method]
+	ipsk := make([]byte, conf.KeyLen)
+	rand.Read(ipsk)
+	g := &config.Group{IdentityPSK: base64.StdEncoding.EncodeToString(ipsk)}
+	upsks := make([][]byte, 100)
+	for i := range upsks {
+		upsks[i] = make([]byte, conf.KeyLen)
+		rand.Read(upsks[i])
+		g.Servers = append(g.Servers, config.Server{
+			Target:   "127.0.0.1:1080",
+			Method:   method,
+			Password: base64.StdEncoding.EncodeToString(upsks[i]),
+		})
+	}
+	g.BuildMasterKeys()
+	g.BuildIdentities()
+	g.BuildUserContextPool(10)
+	d := New(g, config.ListenAddr{Port: g.Port}).(*UDP)
+
+	addr := []byte{cipher.ATypeIPv4, 127, 0, 0, 1, 0, 53}
+	// a packet to the target, then insert the identity header
+	packet := seal2022(t, method, upsks[42], time.Now(), addr)
+	var header [cipher.UDPSeparateHeaderLen]byte
+	userBlock, _ := aes.NewCipher(upsks[42])
+	userBlock.Decrypt(header[:], packet[:cipher.UDPSeparateHeaderLen])
+	identityBlock, _ := aes.NewCipher(ipsk)
+	eih := cipher.NewPSKHash(upsks[42])
+	for i := range eih {
+		eih[i] ^= header[i]
+	}
+	identityBlock.Encrypt(eih[:], eih[:])
+	identityBlock.Encrypt(header[:], header[:])
+	data := bytes.Join([][]byte{header[:], eih[:], packet[cipher.UDPSeparateHeaderLen:]}, nil)
+
+	var buf [65535]byte
+	hit, content := d.AuthIdentity(buf[:], data)
+	if hit != &g.Servers[42] || !bytes.Equal(content, addr) {
+		t.Fatal("failed to look up the user by the identity header")
+	}
+	session, err := newIdentitySession(ipsk, upsks[42])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, ok := session.StripIdentityHeader(data)
+	if !ok || !bytes.Equal(stripped, packet) {
+		t.Error("failed to strip the identity header")
+	}
+
+	data = seal2022(t, method, upsks[42], time.Now(), addr)
+	if hit, _ := d.AuthIdentity(buf[:], data); hit != nil {
+		t.Error("packet without an identity header passed auth")
+	}
+}
+
+func TestDispatcher_Fallback(t *testing.T) {
+	decoy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	g := &config.Group{
+		Name: t.Name(),
+		Port: port,
+		Fallback: &config.FallbackConf{
+			UDP:       config.UDPFallbackForward,
+			UDPTarget: decoy.LocalAddr().String(),
+		},
+		Servers: []config.Server{{
+			Target:   "127.0.0.1:1",
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildMasterKeys()
+	g.BuildUserContextPool(time.Minute)
+	g.BuildFallback()
+	d := New(g, config.ListenAddr{Port: g.Port}).(*UDP)
+	go d.Listen()
+	defer d.Close()
+
+	c, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	packet := []byte("unauthenticated packet of a QUIC handshake")
+	b := make([]byte, 1500)
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatal("the decoy received nothing")
+		}
+		c.Write(packet)
+		decoy.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, from, err := decoy.ReadFrom(b)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(b[:n], packet) {
+			t.Fatalf("unexpected packet received by the decoy: %q", b[:n])
+		}
+		decoy.WriteTo([]byte("response"), from)
+		break
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "response" {
+		t.Fatalf("unexpected response: %q", b[:n])
+	}
+}
+
+// startSession starts a dispatcher forwarding unauthenticated packets to a decoy, and a session through it.
+func startSession(t *testing.T) (d *UDP, c net.Conn, decoy *net.UDPConn, port int) {
+	var err error
+	decoy, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { decoy.Close() })
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port = l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	g := &config.Group{
+		Name: t.Name(),
+		Port: port,
+		Fallback: &config.FallbackConf{
+			UDP:       config.UDPFallbackForward,
+			UDPTarget: decoy.LocalAddr().String(),
+		},
+		Servers: []config.Server{{
+			Target:   "127.0.0.1:1",
+			Method:   "aes-256-gcm",
+			Password: "password",
+		}},
+	}
+	g.BuildMasterKeys()
+	g.BuildUserContextPool(time.Minute)
+	g.BuildFallback()
+	d = New(g, config.ListenAddr{Port: g.Port}).(*UDP)
+	go d.Listen()
+	t.Cleanup(func() { d.Close() })
+
+	c, err = net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	b := make([]byte, 1500)
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatal("the decoy received nothing")
+		}
+		c.Write([]byte("packet"))
+		decoy.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err = decoy.ReadFrom(b); err == nil {
+			break
+		}
+	}
+	if d.tracker.Len() != 1 {
+		t.Fatalf("expect 1 active session, got %v", d.tracker.Len())
+	}
+	return d, c, decoy, port
+}
+
+func TestDispatcher_Shutdown(t *testing.T) {
+	d, c, decoy, port := startSession(t)
+	b := make([]byte, 1500)
+
+	// the session keeps relaying while draining, but no new session is built
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	ch := make(chan error, 1)
+	go func() {
+		ch <- d.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Write([]byte("draining"))
+	decoy.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := decoy.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("the session should keep relaying while draining: %v", err)
+		}
+		if string(b[:n]) == "draining" {
+			break
+		}
+	}
+	newClient, err := net.Dial("udp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newClient.Close()
+	newClient.Write([]byte("packet"))
+	decoy.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err = decoy.ReadFrom(b); err == nil {
+		t.Fatal("a new session should not be built while draining")
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown should return after the drain timeout")
+	}
+	if d.tracker.Len() != 0 {
+		t.Fatalf("expect the sessions to be force-closed, got %v", d.tracker.Len())
+	}
+	l, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Fatalf("the address should be free after Shutdown: %v", err)
+	}
+	l.Close()
+}
+
+func TestDispatcher_Unlisten(t *testing.T) {
+	d, _, _, port := startSession(t)
+	if err := d.Unlisten(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Fatalf("the address should be free after Unlisten: %v", err)
+	}
+	l.Close()
+
+	// the session cannot reply without the socket, so there is nothing to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ch := make(chan error, 1)
+	go func() {
+		ch <- d.Shutdown(ctx)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown should not wait for sessions after closing the socket")
+	}
+	if d.tracker.Len() != 0 {
+		t.Fatalf("expect the sessions to be force-closed, got %v", d.tracker.Len())
+	}
+}
@@ -8,6 +8,10 @@ require (
 	golang.org/x/net v0.0.0-20211020060615-d418f374d309
 )
 
-require golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359 // indirect
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 
-require github.com/database64128/tfo-go v1.0.2
+require (
+	github.com/database64128/tfo-go v1.0.2
+	golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359
+	lukechampine.com/blake3 v1.1.7
+)
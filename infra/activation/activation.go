@@ -0,0 +1,217 @@
+// Package activation receives listening sockets passed by systemd socket activation,
+// see sd_listen_fds(3), or by the parent process on upgrading.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ListenFdsStart is the first file descriptor passed.
+const ListenFdsStart = 3
+
+// Socket is a listening socket passed to the process.
+type Socket struct {
+	// Name is set by FileDescriptorName= of the socket unit, which defaults to the name of the unit.
+	Name string
+
+	listener   net.Listener
+	packetConn net.PacketConn
+	taken      bool
+}
+
+// Network returns "tcp" for stream sockets and "udp" for datagram sockets.
+func (s *Socket) Network() string {
+	if s.listener != nil {
+		return "tcp"
+	}
+	return "udp"
+}
+
+func (s *Socket) Addr() net.Addr {
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return s.packetConn.LocalAddr()
+}
+
+var (
+	mu      sync.Mutex
+	once    sync.Once
+	sockets []*Socket
+)
+
+// Sockets returns the sockets passed to the process.
+func Sockets() []*Socket {
+	once.Do(func() {
+		sockets = parse()
+	})
+	return sockets
+}
+
+func parse() (result []*Socket) {
+	defer func() {
+		// do not pass them to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(ppidEnv)
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	ppid, ppidErr := strconv.Atoi(os.Getenv(ppidEnv))
+	if (err != nil || pid != os.Getpid()) && (ppidErr != nil || ppid != os.Getppid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		files = append(files, os.NewFile(uintptr(ListenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(ListenFdsStart+i)))
+	}
+	return fromFiles(files, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+}
+
+// fromFiles converts files to sockets and closes them. Files of other types are ignored.
+func fromFiles(files []*os.File, names []string) (result []*Socket) {
+	for i, f := range files {
+		s := new(Socket)
+		if i < len(names) {
+			s.Name = names[i]
+		}
+		// the net package duplicates the file descriptor
+		if l, err := net.FileListener(f); err == nil {
+			s.listener = l
+			result = append(result, s)
+		} else if c, err := net.FilePacketConn(f); err == nil {
+			s.packetConn = c
+			result = append(result, s)
+		}
+		f.Close()
+	}
+	return result
+}
+
+// Named returns the sockets with the name.
+func Named(name string) []*Socket {
+	var named []*Socket
+	for _, s := range Sockets() {
+		if s.Name == name {
+			named = append(named, s)
+		}
+	}
+	return named
+}
+
+// Match reports whether s is bound to ip and port. A nil ip matches sockets bound to unspecified addresses.
+func (s *Socket) Match(network string, ip net.IP, port int) bool {
+	if s.Network() != network {
+		return false
+	}
+	var sip net.IP
+	var sport int
+	switch addr := s.Addr().(type) {
+	case *net.TCPAddr:
+		sip, sport = addr.IP, addr.Port
+	case *net.UDPAddr:
+		sip, sport = addr.IP, addr.Port
+	default:
+		return false
+	}
+	if sport != port {
+		return false
+	}
+	if ip == nil {
+		return sip == nil || sip.IsUnspecified()
+	}
+	return sip.Equal(ip)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// dup duplicates the socket so that closing the duplicate keeps the socket bound.
+func (s *Socket) dup() (*os.File, error) {
+	if s.listener != nil {
+		return s.listener.(filer).File()
+	}
+	return s.packetConn.(filer).File()
+}
+
+// TakeListener returns a duplicate of the first stream socket not in use which satisfies match, or nil if none.
+// Call release after closing the listener to allow taking the socket again.
+func TakeListener(match func(s *Socket) bool) (l net.Listener, release func(), err error) {
+	s, f, err := take("tcp", match)
+	if s == nil || err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	if l, err = net.FileListener(f); err != nil {
+		s.release()
+		return nil, nil, err
+	}
+	return l, s.release, nil
+}
+
+// TakePacketConn returns a duplicate of the first datagram socket not in use which satisfies match, or nil if none.
+// Call release after closing the connection to allow taking the socket again.
+func TakePacketConn(match func(s *Socket) bool) (c *net.UDPConn, release func(), err error) {
+	s, f, err := take("udp", match)
+	if s == nil || err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		s.release()
+		return nil, nil, err
+	}
+	c, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		s.release()
+		return nil, nil, fmt.Errorf("not a UDP socket: %v", pc.LocalAddr())
+	}
+	return c, s.release, nil
+}
+
+func take(network string, match func(s *Socket) bool) (*Socket, *os.File, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range Sockets() {
+		if !s.taken && s.Network() == network && match(s) {
+			f, err := s.dup()
+			if err != nil {
+				return nil, nil, err
+			}
+			s.taken = true
+			return s, f, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (s *Socket) release() {
+	mu.Lock()
+	defer mu.Unlock()
+	s.taken = false
+}
+
+// Untaken returns the sockets not in use.
+func Untaken() []*Socket {
+	mu.Lock()
+	defer mu.Unlock()
+	var untaken []*Socket
+	for _, s := range Sockets() {
+		if !s.taken {
+			untaken = append(untaken, s)
+		}
+	}
+	return untaken
+}
@@ -0,0 +1,104 @@
+package activation
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	lf, _ := l.(*net.TCPListener).File()
+	cf, _ := c.File()
+	sockets = fromFiles([]*os.File{lf, cf}, []string{"a", "b"})
+	once.Do(func() {})
+	tcpPort := l.Addr().(*net.TCPAddr).Port
+	udpPort := c.LocalAddr().(*net.UDPAddr).Port
+
+	if len(Named("a")) != 1 || Named("a")[0].Network() != "tcp" || Named("b")[0].Network() != "udp" {
+		t.Fatalf("unexpected sockets: %+v", sockets)
+	}
+	byPort := func(port int) func(s *Socket) bool {
+		return func(s *Socket) bool {
+			return s.Match(s.Network(), net.IPv4(127, 0, 0, 1), port)
+		}
+	}
+	if l, _, _ := TakeListener(byPort(udpPort)); l != nil {
+		t.Fatal("took a datagram socket as a listener")
+	}
+	tl, release, err := TakeListener(byPort(tcpPort))
+	if err != nil || tl == nil {
+		t.Fatalf("failed to take the listener: %v", err)
+	}
+	if l, _, _ := TakeListener(byPort(tcpPort)); l != nil {
+		t.Fatal("took a socket in use")
+	}
+	// closing the taken listener keeps the socket bound
+	tl.Close()
+	release()
+	if tl, _, _ = TakeListener(byPort(tcpPort)); tl == nil {
+		t.Fatal("failed to take the released listener")
+	}
+	defer tl.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	uc, release, err := TakePacketConn(byPort(udpPort))
+	if err != nil || uc == nil {
+		t.Fatalf("failed to take the packet conn: %v", err)
+	}
+	if len(Untaken()) != 0 {
+		t.Fatalf("expect no untaken socket, got %v", len(Untaken()))
+	}
+	uc.Close()
+	release()
+	if untaken := Untaken(); len(untaken) != 1 || untaken[0].Name != "b" {
+		t.Fatalf("expect 1 untaken socket, got %v", len(Untaken()))
+	}
+}
+
+func TestHandover(t *testing.T) {
+	if os.Getenv("ACTIVATION_TEST_CHILD") == "1" {
+		// the child: report ready only if it receives the socket
+		if s := Named("a"); len(s) == 1 && s[0].Network() == "tcp" && os.Getenv("LISTEN_FDS") == "" {
+			Ready()
+		}
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, _ := l.(*net.TCPListener).File()
+	defer f.Close()
+	os.Setenv("ACTIVATION_TEST_CHILD", "1")
+	defer os.Unsetenv("ACTIVATION_TEST_CHILD")
+	args := []string{"-test.run=^TestHandover$"}
+	if _, err = Handover(os.Args[0], args, []*os.File{f}, []string{"a"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// a child exiting without being ready fails
+	if _, err = Handover(os.Args[0], args, nil, nil, 10*time.Second); err == nil {
+		t.Fatal("expect an error")
+	}
+}
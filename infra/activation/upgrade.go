@@ -0,0 +1,90 @@
+package activation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ppidEnv replaces LISTEN_PID for sockets passed by the parent process,
+	// which cannot know the pid of the child before starting it.
+	ppidEnv    = "MMP_GO_LISTEN_PPID"
+	readyFdEnv = "MMP_GO_READY_FD"
+)
+
+// Handover starts the executable at path with args, passing files to it as sockets of the names.
+// It returns after the child calls Ready, or kills the child if it exits or fails to be ready within timeout.
+func Handover(path string, args []string, files []*os.File, names []string, timeout time.Duration) (*os.Process, error) {
+	for _, name := range names {
+		if strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid socket name: %v", name)
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File(nil), files...), w)
+	cmd.Env = append(os.Environ(),
+		ppidEnv+"="+strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyFdEnv+"="+strconv.Itoa(ListenFdsStart+len(files)),
+	)
+	err = cmd.Start()
+	// only the child holds the write end, so that reading ends if the child exits
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	go cmd.Wait()
+
+	_ = r.SetReadDeadline(time.Now().Add(timeout))
+	var b [1]byte
+	if _, err = r.Read(b[:]); err != nil {
+		_ = cmd.Process.Kill()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("not ready within %v", timeout)
+		}
+		return nil, fmt.Errorf("exited before ready")
+	}
+	return cmd.Process, nil
+}
+
+// Ready tells the parent process passing sockets by Handover and the service manager that the process is ready.
+// It also tells the service manager to take the process as the main process.
+func Ready() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFdEnv)); err == nil {
+		os.Unsetenv(readyFdEnv)
+		f := os.NewFile(uintptr(fd), "ready")
+		_, _ = f.Write([]byte{1})
+		f.Close()
+	}
+	_ = Notify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+}
+
+// Notify sends state to the service manager, see sd_notify(3).
+// It does nothing if not started by systemd.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,70 @@
+package bloom
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// Filter is a bloom filter for byte slices.
+type Filter struct {
+	bits []uint64
+	m    uint64
+	k    int
+	seed maphash.Seed
+}
+
+// New creates a bloom filter for n elements with the false positive rate p.
+func New(n int, p float64) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+		seed: maphash.MakeSeed(),
+	}
+}
+
+func (f *Filter) hash(b []byte) (h1, h2 uint64) {
+	var h maphash.Hash
+	h.SetSeed(f.seed)
+	h.Write(b)
+	sum := h.Sum64()
+	// double hashing
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+func (f *Filter) Add(b []byte) {
+	h1, h2 := f.hash(b)
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) % f.m
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *Filter) Test(b []byte) bool {
+	h1, h2 := f.hash(b)
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint64(i)*h2) % f.m
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) Reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+	f.seed = maphash.MakeSeed()
+}
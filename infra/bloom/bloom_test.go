@@ -0,0 +1,65 @@
+package bloom
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	const n = 10000
+	f := New(n, 1e-6)
+	elements := make([][]byte, n)
+	for i := range elements {
+		elements[i] = make([]byte, 32)
+		rand.Read(elements[i])
+		f.Add(elements[i])
+	}
+	for _, e := range elements {
+		if !f.Test(e) {
+			t.Fatal("false negative")
+		}
+	}
+	var fp int
+	b := make([]byte, 32)
+	for i := 0; i < n; i++ {
+		rand.Read(b)
+		if f.Test(b) {
+			fp++
+		}
+	}
+	if fp > 1 {
+		t.Errorf("too many false positives: %v", fp)
+	}
+}
+
+func TestRotating(t *testing.T) {
+	r := NewRotating(2, 1e-6, 0)
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+	if r.TestAndAdd(a) || r.TestAndAdd(b) {
+		t.Fatal("unexpected positive")
+	}
+	if !r.TestAndAdd(a) {
+		t.Fatal("replay of a not detected")
+	}
+	// c starts a new generation, a and b are still remembered
+	if r.TestAndAdd(c) || !r.TestAndAdd(a) || !r.TestAndAdd(b) {
+		t.Fatal("previous generation forgotten too early")
+	}
+	// fill up the new generation, and a and b are forgotten
+	r.TestAndAdd([]byte("d"))
+	r.TestAndAdd([]byte("e"))
+	if r.TestAndAdd(a) {
+		t.Fatal("old generation not forgotten")
+	}
+
+	r = NewRotating(100, 1e-6, 10*time.Millisecond)
+	r.TestAndAdd(a)
+	time.Sleep(20 * time.Millisecond)
+	r.TestAndAdd(b)
+	time.Sleep(20 * time.Millisecond)
+	r.TestAndAdd(c)
+	if r.TestAndAdd(a) {
+		t.Fatal("expired element not forgotten")
+	}
+}
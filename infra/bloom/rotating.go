@@ -0,0 +1,52 @@
+package bloom
+
+import (
+	"sync"
+	"time"
+)
+
+// Rotating keeps the elements added in the last one or two generations in two bloom filters.
+// A generation ends when it holds capacity elements or lasts for interval, so both the memory
+// and the time an element is remembered are bounded.
+type Rotating struct {
+	mu       sync.Mutex
+	current  *Filter
+	previous *Filter
+	count    int
+	capacity int
+	interval time.Duration
+	rotated  time.Time
+}
+
+// NewRotating creates a rotating bloom filter. An interval of zero means no time limit.
+func NewRotating(capacity int, p float64, interval time.Duration) *Rotating {
+	return &Rotating{
+		current:  New(capacity, p),
+		previous: New(capacity, p),
+		capacity: capacity,
+		interval: interval,
+		rotated:  time.Now(),
+	}
+}
+
+func (r *Rotating) rotate() {
+	r.current, r.previous = r.previous, r.current
+	r.current.Reset()
+	r.count = 0
+	r.rotated = time.Now()
+}
+
+// TestAndAdd reports whether b has been added before, and adds it if not.
+func (r *Rotating) TestAndAdd(b []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current.Test(b) || r.previous.Test(b) {
+		return true
+	}
+	if r.count >= r.capacity || (r.interval > 0 && time.Since(r.rotated) >= r.interval) {
+		r.rotate()
+	}
+	r.current.Add(b)
+	r.count++
+	return false
+}
@@ -0,0 +1,148 @@
+// Package conntrack tracks relayed connections so that they can be listed and terminated.
+package conntrack
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is a relayed TCP connection or UDP NAT session.
+type Conn struct {
+	ID       uint64
+	Protocol string
+	Client   net.Addr
+	Group    string
+	Server   string
+	Target   string
+	Start    time.Time
+
+	up    uint64
+	down  uint64
+	close func()
+	once  sync.Once
+}
+
+// AddUp adds n bytes sent from the client to the target.
+func (c *Conn) AddUp(n uint64) {
+	atomic.AddUint64(&c.up, n)
+}
+
+// AddDown adds n bytes sent from the target to the client.
+func (c *Conn) AddDown(n uint64) {
+	atomic.AddUint64(&c.down, n)
+}
+
+func (c *Conn) Up() uint64 {
+	return atomic.LoadUint64(&c.up)
+}
+
+func (c *Conn) Down() uint64 {
+	return atomic.LoadUint64(&c.down)
+}
+
+// Close terminates the connection. It is safe to call more than once.
+func (c *Conn) Close() {
+	c.once.Do(c.close)
+}
+
+// ClientIP returns the IP of the client, or nil if unknown.
+func (c *Conn) ClientIP() net.IP {
+	switch addr := c.Client.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(c.Client.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Filter selects connections. Empty fields match everything, and an empty Filter matches nothing.
+type Filter struct {
+	ID       uint64
+	ClientIP net.IP
+	Group    string
+	Server   string
+}
+
+func (f *Filter) Empty() bool {
+	return f.ID == 0 && f.ClientIP == nil && f.Group == "" && f.Server == ""
+}
+
+func (f *Filter) Match(c *Conn) bool {
+	if f.Empty() {
+		return false
+	}
+	return (f.ID == 0 || f.ID == c.ID) &&
+		(f.ClientIP == nil || f.ClientIP.Equal(c.ClientIP())) &&
+		(f.Group == "" || f.Group == c.Group) &&
+		(f.Server == "" || f.Server == c.Server)
+}
+
+type Registry struct {
+	mu     sync.Mutex
+	conns  map[uint64]*Conn
+	nextID uint64
+}
+
+// Default is the registry of connections relayed by dispatchers.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[uint64]*Conn)}
+}
+
+// Add registers the connection and assigns an ID to it. close is called when it is killed.
+func (r *Registry) Add(c *Conn, close func()) *Conn {
+	c.close = close
+	if c.Start.IsZero() {
+		c.Start = time.Now()
+	}
+	r.mu.Lock()
+	r.nextID++
+	c.ID = r.nextID
+	r.conns[c.ID] = c
+	r.mu.Unlock()
+	return c
+}
+
+func (r *Registry) Remove(c *Conn) {
+	r.mu.Lock()
+	delete(r.conns, c.ID)
+	r.mu.Unlock()
+}
+
+// List returns the connections matched by the filter ordered by ID, or all connections if the filter is empty.
+func (r *Registry) List(f Filter) []*Conn {
+	r.mu.Lock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		if f.Empty() || f.Match(c) {
+			conns = append(conns, c)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// Kill closes the connections matched by the filter and returns them.
+func (r *Registry) Kill(f Filter) []*Conn {
+	if f.Empty() {
+		return nil
+	}
+	conns := r.List(f)
+	for _, c := range conns {
+		c.Close()
+		r.Remove(c)
+	}
+	return conns
+}
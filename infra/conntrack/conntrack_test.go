@@ -0,0 +1,46 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	closed := make(map[uint64]int)
+	add := func(ip string, server string) *Conn {
+		c := &Conn{
+			Protocol: "tcp",
+			Client:   &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234},
+			Group:    "g",
+			Server:   server,
+		}
+		return r.Add(c, func() { closed[c.ID]++ })
+	}
+	a := add("10.0.0.1", "s1")
+	b := add("10.0.0.2", "s1")
+	c := add("10.0.0.1", "s2")
+
+	if conns := r.List(Filter{}); len(conns) != 3 || conns[0] != a || conns[2] != c {
+		t.Fatalf("unexpected list: %v", conns)
+	}
+	if conns := r.Kill(Filter{}); len(conns) != 0 {
+		t.Fatal("an empty filter should kill nothing")
+	}
+	if conns := r.Kill(Filter{ClientIP: net.ParseIP("10.0.0.1")}); len(conns) != 2 || closed[a.ID] != 1 || closed[c.ID] != 1 {
+		t.Fatalf("unexpected killed: %v", conns)
+	}
+	if conns := r.Kill(Filter{ID: b.ID, Server: "s2"}); len(conns) != 0 {
+		t.Fatal("all fields of the filter should match")
+	}
+	if conns := r.Kill(Filter{Server: "s1"}); len(conns) != 1 || conns[0] != b {
+		t.Fatalf("unexpected killed: %v", conns)
+	}
+	b.Close()
+	if closed[b.ID] != 1 {
+		t.Fatal("close should be called once")
+	}
+	if len(r.List(Filter{})) != 0 {
+		t.Fatal("killed connections should be removed")
+	}
+}
@@ -0,0 +1,120 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader   = errors.New("no PROXY protocol header")
+	ErrIncomplete = errors.New("incomplete PROXY protocol header")
+	ErrInvalid    = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	v1Prefix       = "PROXY "
+	v1MaxHeaderLen = 107
+	v2HeaderLen    = 16
+)
+
+// Parse parses the PROXY protocol header at the beginning of b.
+// It returns the addresses carried by the header and the length of the header.
+// src and dst are nil if the header does not carry addresses, e.g. health checks of the proxy.
+// ErrIncomplete means b is a prefix of a header and more bytes are needed.
+func Parse(b []byte) (src, dst net.Addr, n int, err error) {
+	switch {
+	case hasPrefix(b, Signature):
+		if len(b) < len(Signature) {
+			return nil, nil, 0, ErrIncomplete
+		}
+		return parseV2(b)
+	case hasPrefix(b, []byte(v1Prefix)):
+		if len(b) < len(v1Prefix) {
+			return nil, nil, 0, ErrIncomplete
+		}
+		return parseV1(b)
+	}
+	return nil, nil, 0, ErrNoHeader
+}
+
+// hasPrefix reports whether b and prefix agree on their common length.
+func hasPrefix(b []byte, prefix []byte) bool {
+	if len(b) > len(prefix) {
+		b = b[:len(prefix)]
+	}
+	return len(b) > 0 && bytes.Equal(b, prefix[:len(b)])
+}
+
+func parseV1(b []byte) (src, dst net.Addr, n int, err error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end == -1 {
+		if len(b) >= v1MaxHeaderLen {
+			return nil, nil, 0, ErrInvalid
+		}
+		return nil, nil, 0, ErrIncomplete
+	}
+	n = end + 2
+	if n > v1MaxHeaderLen {
+		return nil, nil, 0, ErrInvalid
+	}
+	fields := strings.Split(string(b[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, n, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, 0, ErrInvalid
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, 0, ErrInvalid
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, n, nil
+}
+
+func parseV2(b []byte) (src, dst net.Addr, n int, err error) {
+	if len(b) < v2HeaderLen {
+		return nil, nil, 0, ErrIncomplete
+	}
+	if b[12]>>4 != Version2 {
+		return nil, nil, 0, ErrInvalid
+	}
+	n = v2HeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, nil, 0, ErrIncomplete
+	}
+	switch b[12] {
+	case commandLocal:
+		return nil, nil, n, nil
+	case commandProxy:
+	default:
+		return nil, nil, 0, ErrInvalid
+	}
+	addr := b[v2HeaderLen:n]
+	var ipLen int
+	switch b[13] {
+	case familyTCP4, familyUDP4:
+		ipLen = 4
+	case familyTCP6, familyUDP6:
+		ipLen = 16
+	default:
+		// unsupported address family, ignore the addresses
+		return nil, nil, n, nil
+	}
+	if len(addr) < 2*ipLen+4 {
+		return nil, nil, 0, ErrInvalid
+	}
+	srcIP := net.IP(append([]byte(nil), addr[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), addr[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(addr[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(addr[2*ipLen+2:]))
+	if b[13]&0x0f == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, n, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, n, nil
+}
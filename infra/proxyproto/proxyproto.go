@@ -0,0 +1,121 @@
+// Package proxyproto implements the PROXY protocol.
+// https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+var Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	commandLocal = 0x20
+	commandProxy = 0x21
+
+	familyUnspec  = 0x00
+	familyTCP4    = 0x11
+	familyUDP4    = 0x12
+	familyTCP6    = 0x21
+	familyUDP6    = 0x22
+	v2AddrLenIPv4 = 4 + 4 + 2 + 2
+	v2AddrLenIPv6 = 16 + 16 + 2 + 2
+)
+
+// ParseVersion parses "v1" or "v2" to the version number. "" and "none" mean disabled.
+func ParseVersion(s string) (int, error) {
+	switch s {
+	case "", "none":
+		return 0, nil
+	case "v1":
+		return Version1, nil
+	case "v2":
+		return Version2, nil
+	}
+	return 0, fmt.Errorf("unknown PROXY protocol version: %v", s)
+}
+
+func ipPort(addr net.Addr) (net.IP, int, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, true
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	}
+	return nil, 0, false
+}
+
+// normalize converts the two IPs to the same family.
+func normalize(src, dst net.IP) (net.IP, net.IP, bool) {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		return src4, dst4, true
+	} else if src4 != nil && dst.IsUnspecified() {
+		return src4, net.IPv4zero.To4(), true
+	}
+	return src.To16(), dst.To16(), false
+}
+
+// AppendHeader appends the PROXY protocol header of the given version to b.
+// The transport protocol is inferred from the type of src. Version 1 supports TCP only.
+func AppendHeader(b []byte, version int, src, dst net.Addr) []byte {
+	if version == Version1 {
+		return appendV1(b, src, dst)
+	}
+	return appendV2(b, src, dst)
+}
+
+func appendV1(b []byte, src, dst net.Addr) []byte {
+	srcIP, srcPort, ok1 := ipPort(src)
+	dstIP, dstPort, ok2 := ipPort(dst)
+	if _, tcp := src.(*net.TCPAddr); !tcp || !ok1 || !ok2 {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	srcIP, dstIP, v4 := normalize(srcIP, dstIP)
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	b = append(b, "PROXY "+proto+" "+srcIP.String()+" "+dstIP.String()+" "...)
+	b = strconv.AppendInt(b, int64(srcPort), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(dstPort), 10)
+	return append(b, "\r\n"...)
+}
+
+func appendV2(b []byte, src, dst net.Addr) []byte {
+	b = append(b, Signature...)
+	srcIP, srcPort, ok1 := ipPort(src)
+	dstIP, dstPort, ok2 := ipPort(dst)
+	if !ok1 || !ok2 {
+		return append(b, commandLocal, familyUnspec, 0, 0)
+	}
+	_, udp := src.(*net.UDPAddr)
+	srcIP, dstIP, v4 := normalize(srcIP, dstIP)
+	var family byte
+	var addrLen int
+	switch {
+	case v4 && udp:
+		family, addrLen = familyUDP4, v2AddrLenIPv4
+	case v4:
+		family, addrLen = familyTCP4, v2AddrLenIPv4
+	case udp:
+		family, addrLen = familyUDP6, v2AddrLenIPv6
+	default:
+		family, addrLen = familyTCP6, v2AddrLenIPv6
+	}
+	b = append(b, commandProxy, family, byte(addrLen>>8), byte(addrLen))
+	b = append(b, srcIP...)
+	b = append(b, dstIP...)
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(srcPort))
+	b = append(b, port[:]...)
+	binary.BigEndian.PutUint16(port[:], uint16(dstPort))
+	return append(b, port[:]...)
+}
@@ -0,0 +1,88 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAppendHeader(t *testing.T) {
+	tcp4Src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	tcp4Dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	tcp6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	tcp6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+		expect   []byte
+	}{
+		{Version1, tcp4Src, tcp4Dst, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")},
+		{Version1, tcp6Src, tcp6Dst, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{Version1, tcp4Src, &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, []byte("PROXY TCP4 192.0.2.1 0.0.0.0 56324 443\r\n")},
+		{Version1, &net.UDPAddr{}, &net.UDPAddr{}, []byte("PROXY UNKNOWN\r\n")},
+		{Version2, tcp4Src, tcp4Dst, bytes.Join([][]byte{Signature,
+			{0x21, 0x11, 0, 12, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}}, nil)},
+		{Version2, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, bytes.Join([][]byte{Signature,
+			{0x21, 0x12, 0, 12, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}}, nil)},
+		{Version2, tcp6Src, tcp6Dst, bytes.Join([][]byte{Signature,
+			{0x21, 0x21, 0, 36}, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), {0xdc, 0x04, 0x01, 0xbb}}, nil)},
+		{Version2, &net.UnixAddr{}, &net.UnixAddr{}, bytes.Join([][]byte{Signature, {0x20, 0x00, 0, 0}}, nil)},
+	}
+	for _, tt := range tests {
+		if h := AppendHeader(nil, tt.version, tt.src, tt.dst); !bytes.Equal(h, tt.expect) {
+			t.Errorf("v%v %v -> %v: expect %q, got %q", tt.version, tt.src, tt.dst, tt.expect, h)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	addrs := [][2]net.Addr{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}, &net.UDPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}},
+	}
+	payload := []byte("payload")
+	for _, version := range []int{Version1, Version2} {
+		for _, a := range addrs {
+			if _, udp := a[0].(*net.UDPAddr); udp && version == Version1 {
+				continue
+			}
+			header := AppendHeader(nil, version, a[0], a[1])
+			b := append(append([]byte(nil), header...), payload...)
+			src, dst, n, err := Parse(b)
+			if err != nil {
+				t.Fatalf("v%v %v: %v", version, a, err)
+			}
+			if n != len(header) || src.String() != a[0].String() || dst.String() != a[1].String() || src.Network() != a[0].Network() {
+				t.Errorf("v%v %v: got %v %v %v", version, a, src, dst, n)
+			}
+			for i := 0; i < len(header); i++ {
+				if _, _, _, err := Parse(b[:i]); err != ErrIncomplete && !(i == 0 && err == ErrNoHeader) {
+					t.Fatalf("v%v %v: prefix of %v bytes: %v", version, a, i, err)
+				}
+			}
+		}
+	}
+
+	tests := []struct {
+		b   []byte
+		n   int
+		err error
+	}{
+		{[]byte("PROXY UNKNOWN\r\npayload"), 15, nil},
+		{AppendHeader(nil, Version2, &net.UnixAddr{}, &net.UnixAddr{}), 16, nil},
+		{[]byte("GET / HTTP/1.1\r\n"), 0, ErrNoHeader},
+		{payload, 0, ErrNoHeader},
+		{[]byte("PROXY TCP4 1.1.1.1 2.2.2.2 80\r\n"), 0, ErrInvalid},
+		{[]byte("PROXY TCP4 1.1.1.1 2.2.2.2 80 65536\r\n"), 0, ErrInvalid},
+		{append([]byte("PROXY "), bytes.Repeat([]byte{'1'}, 200)...), 0, ErrInvalid},
+		{append(append([]byte(nil), Signature...), 0x11, 0x11, 0, 0), 0, ErrInvalid},
+	}
+	for _, tt := range tests {
+		src, _, n, err := Parse(tt.b)
+		if err != tt.err || n != tt.n || src != nil {
+			t.Errorf("%q: expect %v %v, got %v %v %v", tt.b, tt.n, tt.err, src, n, err)
+		}
+	}
+}
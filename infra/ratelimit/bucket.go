@@ -0,0 +1,122 @@
+// Package ratelimit implements token buckets to shape traffic.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MinBurst is the least tokens a bucket holds, so that a datagram of the largest size can pass a low rate.
+const MinBurst = 64 << 10
+
+// Bucket is a token bucket refilled at a rate of tokens per second, holding up to one second of tokens or MinBurst.
+// A nil Bucket or a Bucket with a rate of zero is unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate. Tokens taken are not affected.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if rate < 0 {
+		rate = 0
+	}
+	enabled := b.rate == 0
+	b.rate = float64(rate)
+	if enabled || b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+func (b *Bucket) burst() float64 {
+	if b.rate < MinBurst {
+		return MinBurst
+	}
+	return b.rate
+}
+
+func (b *Bucket) Rate() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst() {
+			b.tokens = b.burst()
+		}
+	}
+	b.last = now
+}
+
+// Reserve takes n tokens even if there are not enough, and returns how long to wait for the debt to be paid.
+func (b *Bucket) Reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens and blocks until they are available.
+func (b *Bucket) Wait(n int) {
+	if d := b.Reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Allow takes n tokens and returns true if they are available, otherwise it takes nothing and returns false.
+func (b *Bucket) Allow(n int) bool {
+	return AllowAll([]*Bucket{b}, n)
+}
+
+// AllowAll takes n tokens from each bucket and returns true if all of them have enough,
+// otherwise it takes nothing and returns false. Buckets shared by callers should be passed in the same order.
+func AllowAll(buckets []*Bucket, n int) bool {
+	now := time.Now()
+	limited := make([]*Bucket, 0, len(buckets))
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.rate == 0 {
+			continue
+		}
+		b.refill(now)
+		if b.tokens < float64(n) {
+			return false
+		}
+		limited = append(limited, b)
+	}
+	for _, b := range limited {
+		b.tokens -= float64(n)
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_Wait(t *testing.T) {
+	b := NewBucket(100 << 10)
+	start := time.Now()
+	// the first second of tokens is available at once
+	for i := 0; i < 30; i++ {
+		b.Wait(10 << 10)
+	}
+	if elapsed := time.Since(start); elapsed < 1900*time.Millisecond || elapsed > 2500*time.Millisecond {
+		t.Fatalf("expect about 2s to take 300KiB at 100KiB/s with 100KiB burst, got %v", elapsed)
+	}
+}
+
+func TestBucket_Allow(t *testing.T) {
+	b := NewBucket(100 << 10)
+	if !b.Allow(100 << 10) {
+		t.Fatal("the burst should be allowed")
+	}
+	if b.Allow(10 << 10) {
+		t.Fatal("the bucket should be empty")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.Allow(10 << 10) {
+		t.Fatal("the bucket should be refilled")
+	}
+
+	// a datagram of the largest size passes a low rate
+	b = NewBucket(1000)
+	if !b.Allow(65535) || b.Allow(1000) {
+		t.Fatal("the bucket should hold MinBurst")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	full, empty := NewBucket(100<<10), NewBucket(100<<10)
+	empty.Allow(100 << 10)
+	if AllowAll([]*Bucket{full, empty, nil}, 10<<10) {
+		t.Fatal("a packet should not pass an empty bucket")
+	}
+	if !full.Allow(100 << 10) {
+		t.Fatal("a rejected packet should not take tokens of any bucket")
+	}
+}
+
+func TestBucket_SetRate(t *testing.T) {
+	var nilBucket *Bucket
+	if nilBucket.Reserve(1<<30) != 0 || !nilBucket.Allow(1<<30) {
+		t.Fatal("a nil bucket should be unlimited")
+	}
+	b := NewBucket(0)
+	if b.Reserve(1<<30) != 0 {
+		t.Fatal("a zero rate should be unlimited")
+	}
+	b.SetRate(100 << 10)
+	if !b.Allow(100<<10) || b.Allow(1) {
+		t.Fatal("the bucket should be full after enabling the limit")
+	}
+	b.SetRate(0)
+	if !b.Allow(1 << 30) {
+		t.Fatal("the bucket should be unlimited after disabling the limit")
+	}
+}
@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	PreferIPv4 = "prefer-ipv4"
+	PreferIPv6 = "prefer-ipv6"
+	IPv4Only   = "ipv4-only"
+	IPv6Only   = "ipv6-only"
+
+	// FallbackDelay is how long to wait before dialing the other IP family, as recommended by RFC 8305.
+	FallbackDelay = 300 * time.Millisecond
+)
+
+// DialFunc dials an "ip:port" address.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ParsePreference checks the IP family preference: "prefer-ipv4", "prefer-ipv6", "ipv4-only", "ipv6-only" or "" for the order of the answers.
+func ParsePreference(preference string) error {
+	switch preference {
+	case "", PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return nil
+	}
+	return fmt.Errorf("unknown IP preference: %v", preference)
+}
+
+// Sort returns the addresses in the order of preference, without the ones of the excluded family.
+func Sort(ips []net.IP, preference string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch preference {
+	case PreferIPv4:
+		return append(v4, v6...)
+	case PreferIPv6:
+		return append(v6, v4...)
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	}
+	return ips
+}
+
+// Dial resolves the host of the address and dials the IPs in the order of preference.
+// TCP dials the other IP family in parallel after FallbackDelay (happy eyeballs), while other networks dial in turn.
+func (r *Resolver) Dial(ctx context.Context, network, address string, preference string, dial DialFunc) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ips = Sort(ips, preference); len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no address of the preferred IP family", Name: host}
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return dialSerial(ctx, network, port, ips, dial)
+	}
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, network, port, primaries, dial)
+	}
+	return dialParallel(ctx, network, port, primaries, fallbacks, dial)
+}
+
+func dialSerial(ctx context.Context, network, port string, ips []net.IP, dial DialFunc) (c net.Conn, err error) {
+	for _, ip := range ips {
+		if c, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// dialParallel races the primaries and the fallbacks started after FallbackDelay or the primaries fail.
+func dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IP, dial DialFunc) (net.Conn, error) {
+	type result struct {
+		c       net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result)
+	race := func(ips []net.IP, primary bool) {
+		c, err := dialSerial(ctx, network, port, ips, dial)
+		select {
+		case results <- result{c: c, err: err, primary: primary}:
+		case <-ctx.Done():
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+	go race(primaries, true)
+	timer := time.NewTimer(FallbackDelay)
+	defer timer.Stop()
+	var firstErr error
+	fallbackStarted := false
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.c, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				// no need to wait
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+		}
+	}
+	return nil, firstErr
+}
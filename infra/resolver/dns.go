@@ -0,0 +1,187 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxUDPSize = 1232
+
+// exchangeIP queries A and AAAA records of the host from the server, and returns the addresses with the lowest TTL of them.
+func exchangeIP(ctx context.Context, server string, host string) (ips []net.IP, ttl time.Duration, err error) {
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	}
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	// IPv6 goes first as the default policy of RFC 6724
+	qtypes := []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(r *result, qtype dnsmessage.Type) {
+			defer wg.Done()
+			r.ips, r.ttl, r.err = exchange(ctx, server, name, qtype)
+		}(&results[i], qtype)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if len(r.ips) > 0 && (len(ips) == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+	if len(ips) > 0 {
+		// one of the families is enough
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no such host")
+	}
+	dnsErr := &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	if e, ok := err.(*rcodeError); ok {
+		dnsErr.IsNotFound = e.rcode == dnsmessage.RCodeNameError
+	} else if e, ok := err.(net.Error); ok {
+		dnsErr.IsTimeout = e.Timeout()
+	} else {
+		dnsErr.IsNotFound = true
+	}
+	return nil, 0, dnsErr
+}
+
+type rcodeError struct {
+	rcode dnsmessage.RCode
+}
+
+func (e *rcodeError) Error() string {
+	if e.rcode == dnsmessage.RCodeNameError {
+		return "no such host"
+	}
+	return "server replied " + e.rcode.String()
+}
+
+func dnsFQDN(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
+
+// exchange sends a query over UDP, and over TCP again if the response is truncated.
+func exchange(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := exchangeUDP(ctx, server, id, query)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeTCP(ctx, server, id, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, &rcodeError{rcode: resp.RCode}
+	}
+	var ips []net.IP
+	var ttl uint32
+	for i, answer := range resp.Answers {
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.AAAA[:]...)))
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func exchangeUDP(ctx context.Context, server string, id uint16, query []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err = c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var resp dnsmessage.Message
+		if err = resp.Unpack(buf[:n]); err != nil || resp.ID != id || !resp.Response {
+			// ignore spoofed or broken responses
+			continue
+		}
+		return &resp, nil
+	}
+}
+
+func exchangeTCP(ctx context.Context, server string, id uint16, query []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = c.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(c, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if resp.ID != id {
+		return nil, fmt.Errorf("mismatched response ID")
+	}
+	return &resp, nil
+}
@@ -0,0 +1,152 @@
+// Package resolver resolves host names with caching, and dials the addresses in the order of preference.
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinTTL      = 5 * time.Second
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 10 * time.Second
+	DefaultTimeout     = 5 * time.Second
+
+	// SystemTTL is the TTL of answers of the system resolver, which does not tell TTLs.
+	SystemTTL = time.Minute
+)
+
+type Options struct {
+	// Server is the address of the DNS server, e.g. "1.1.1.1:53". The system resolver is used if empty.
+	Server string
+	// MinTTL and MaxTTL bound the time to cache answers.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is the time to cache failed lookups. Negative disables negative caching.
+	NegativeTTL time.Duration
+	// Timeout limits the time of a lookup.
+	Timeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.MinTTL <= 0 {
+		o.MinTTL = DefaultMinTTL
+	}
+	if o.MaxTTL <= 0 {
+		o.MaxTTL = DefaultMaxTTL
+	}
+	if o.MaxTTL < o.MinTTL {
+		o.MaxTTL = o.MinTTL
+	}
+	if o.NegativeTTL == 0 {
+		o.NegativeTTL = DefaultNegativeTTL
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	return o
+}
+
+type entry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+	// done is closed when the lookup ends
+	done chan struct{}
+}
+
+// Resolver resolves host names to IPv4 and IPv6 addresses and caches the answers.
+type Resolver struct {
+	mu      sync.Mutex
+	opts    Options
+	entries map[string]*entry
+
+	// now is replaced by tests
+	now func() time.Time
+}
+
+func New(opts Options) *Resolver {
+	return &Resolver{
+		opts:    opts.withDefaults(),
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// SetOptions replaces the options. The cache is cleared if the server changes.
+func (r *Resolver) SetOptions(opts Options) {
+	opts = opts.withDefaults()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if opts.Server != r.opts.Server {
+		r.entries = make(map[string]*entry)
+	}
+	r.opts = opts
+}
+
+// LookupIP returns the addresses of the host, from the cache if not expired. IP literals are returned as they are.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	if ok {
+		select {
+		case <-e.done:
+			if r.now().Before(e.expire) {
+				r.mu.Unlock()
+				return e.ips, e.err
+			}
+			ok = false
+		default:
+			// wait for the lookup in flight
+		}
+	}
+	if !ok {
+		e = &entry{done: make(chan struct{})}
+		r.entries[host] = e
+		go r.lookup(host, e, r.opts)
+	}
+	r.mu.Unlock()
+	select {
+	case <-e.done:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Resolver) lookup(host string, e *entry, opts Options) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	var ttl time.Duration
+	if opts.Server != "" {
+		e.ips, ttl, e.err = exchangeIP(ctx, opts.Server, host)
+	} else {
+		ttl = SystemTTL
+		var addrs []net.IPAddr
+		if addrs, e.err = net.DefaultResolver.LookupIPAddr(ctx, host); e.err == nil {
+			for _, addr := range addrs {
+				e.ips = append(e.ips, addr.IP)
+			}
+		}
+	}
+	switch {
+	case e.err != nil:
+		ttl = opts.NegativeTTL
+	case ttl < opts.MinTTL:
+		ttl = opts.MinTTL
+	case ttl > opts.MaxTTL:
+		ttl = opts.MaxTTL
+	}
+	r.mu.Lock()
+	e.expire = r.now().Add(ttl)
+	if ttl <= 0 && r.entries[host] == e {
+		delete(r.entries, host)
+	}
+	close(e.done)
+	r.mu.Unlock()
+}
@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a local DNS stand-in answering A and AAAA queries from records.
+type dnsServer struct {
+	conn    net.PacketConn
+	records map[string][]net.IP
+	ttl     uint32
+	queries int32
+}
+
+func newDNSServer(t *testing.T, records map[string][]net.IP, ttl uint32) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{conn: conn, records: records, ttl: ttl}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *dnsServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		atomic.AddInt32(&s.queries, 1)
+		q := query.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		ips, ok := s.records[q.Name.String()]
+		if !ok {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		for _, ip := range ips {
+			header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: s.ttl}
+			switch {
+			case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &a})
+			case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &aaaa})
+			}
+		}
+		b, _ := resp.Pack()
+		s.conn.WriteTo(b, addr)
+	}
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{
+		"example.test.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	}, 1)
+	r := New(Options{Server: server.addr(), MinTTL: 5 * time.Second, NegativeTTL: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ips, err := r.LookupIP(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("expect 2 addresses, got %v", ips)
+	}
+	// the TTL of 1s is raised to MinTTL
+	now = now.Add(3 * time.Second)
+	if _, err = r.LookupIP(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if q := atomic.LoadInt32(&server.queries); q != 2 {
+		t.Fatalf("expect the answer to be cached, got %v queries", q)
+	}
+	now = now.Add(3 * time.Second)
+	if _, err = r.LookupIP(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if q := atomic.LoadInt32(&server.queries); q != 4 {
+		t.Fatalf("expect the answer to expire, got %v queries", q)
+	}
+
+	// negative caching
+	for i := 0; i < 2; i++ {
+		_, err = r.LookupIP(context.Background(), "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	}
+	if q := atomic.LoadInt32(&server.queries); q != 6 {
+		t.Fatalf("expect the failure to be cached, got %v queries", q)
+	}
+
+	// IP literals are not resolved
+	if ips, err = r.LookupIP(context.Background(), "::1"); err != nil || !ips[0].Equal(net.IPv6loopback) {
+		t.Fatalf("unexpected result of an IP literal: %v %v", ips, err)
+	}
+}
+
+func TestResolver_Dial(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{
+		"dual.test.": {net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")},
+	}, 60)
+	r := New(Options{Server: server.addr()})
+
+	var mu sync.Mutex
+	var dialed []string
+	// IPv6 hangs until canceled, while IPv4 connects to a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		if host, _, _ := net.SplitHostPort(address); host != "127.0.0.1" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	start := time.Now()
+	c, err := r.Dial(context.Background(), "tcp", net.JoinHostPort("dual.test", port), "", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if elapsed := time.Since(start); elapsed < FallbackDelay {
+		t.Errorf("IPv4 should be dialed after the fallback delay, got %v", elapsed)
+	}
+	if len(dialed) != 2 || dialed[0] != net.JoinHostPort("2001:db8::1", port) {
+		t.Fatalf("unexpected dials: %v", dialed)
+	}
+
+	dialed = nil
+	if c, err = r.Dial(context.Background(), "tcp", net.JoinHostPort("dual.test", port), PreferIPv4, dial); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(dialed) != 1 {
+		t.Fatalf("expect IPv4 to be dialed first, got %v", dialed)
+	}
+
+	if _, err = r.Dial(context.Background(), "udp", "dual.test:53", IPv6Only, func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != "[2001:db8::1]:53" {
+			t.Errorf("unexpected address of ipv6-only: %v", address)
+		}
+		return nil, errors.New("unreachable")
+	}); err == nil {
+		t.Fatal("expect an error")
+	}
+}
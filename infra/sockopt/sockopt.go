@@ -0,0 +1,20 @@
+// Package sockopt sets socket options of outbound connections.
+package sockopt
+
+import "time"
+
+// Options are socket options applied before connecting. Zero values leave the defaults of the system.
+type Options struct {
+	// Interface binds the socket to a network interface by SO_BINDTODEVICE.
+	Interface string
+	// Mark sets the fwmark for policy routing by SO_MARK.
+	Mark int
+	// TOS sets IP_TOS of IPv4 sockets or IPV6_TCLASS of IPv6 sockets.
+	TOS int
+	// UserTimeout sets TCP_USER_TIMEOUT of TCP sockets.
+	UserTimeout time.Duration
+}
+
+func (o Options) Empty() bool {
+	return o == Options{}
+}
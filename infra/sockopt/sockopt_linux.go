@@ -0,0 +1,54 @@
+package sockopt
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check returns an error if any of the options is not supported on the platform.
+func (o Options) Check() error {
+	return nil
+}
+
+// Control is a Control function of net.Dialer applying the options.
+func (o Options) Control(network, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = o.apply(int(fd), network)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+func (o Options) apply(fd int, network string) error {
+	if o.Interface != "" {
+		if err := unix.BindToDevice(fd, o.Interface); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, o.Mark); err != nil {
+			return err
+		}
+	}
+	if o.TOS != 0 {
+		var err error
+		if strings.HasSuffix(network, "6") {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.TOS)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, o.TOS)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout > 0 && strings.HasPrefix(network, "tcp") {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOptions_Control(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	o := Options{TOS: 46 << 2, UserTimeout: 5 * time.Second}
+	dialer := net.Dialer{Control: o.Control}
+	c, err := dialer.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos, userTimeout int
+	raw.Control(func(fd uintptr) {
+		tos, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+		userTimeout, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+	})
+	if tos != o.TOS {
+		t.Fatalf("expect TOS %v, got %v", o.TOS, tos)
+	}
+	if userTimeout != 5000 {
+		t.Fatalf("expect TCP_USER_TIMEOUT 5000, got %v", userTimeout)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// Check returns an error if any of the options is not supported on the platform.
+func (o Options) Check() error {
+	if !o.Empty() {
+		return fmt.Errorf("interface, mark, DSCP and TCP user timeout are not supported on %v", runtime.GOOS)
+	}
+	return nil
+}
+
+// Control is a Control function of net.Dialer applying the options.
+func (o Options) Control(network, address string, c syscall.RawConn) error {
+	return o.Check()
+}
@@ -1,84 +1,268 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Qv2ray/mmp-go/admin"
 	"github.com/Qv2ray/mmp-go/config"
 	"github.com/Qv2ray/mmp-go/dispatcher"
 	_ "github.com/Qv2ray/mmp-go/dispatcher/tcp"
 	_ "github.com/Qv2ray/mmp-go/dispatcher/udp"
+	"github.com/Qv2ray/mmp-go/infra/activation"
+	"github.com/Qv2ray/mmp-go/metrics"
 )
 
 const HttpClientTimeout = 10 * time.Second
 
-type MapPortDispatcher map[int]*[len(protocols)]dispatcher.Dispatcher
+// MapAddrDispatcher maps listen addresses to their dispatchers.
+type MapAddrDispatcher map[string]*[len(protocols)]dispatcher.Dispatcher
 
-type SyncMapPortDispatcher struct {
+type SyncMapAddrDispatcher struct {
 	sync.Mutex
-	Map MapPortDispatcher
+	Map MapAddrDispatcher
 }
 
-func NewSyncMapPortDispatcher() *SyncMapPortDispatcher {
-	return &SyncMapPortDispatcher{Map: make(MapPortDispatcher)}
+func NewSyncMapAddrDispatcher() *SyncMapAddrDispatcher {
+	return &SyncMapAddrDispatcher{Map: make(MapAddrDispatcher)}
 }
 
 var (
 	protocols       = [...]string{"tcp", "udp"}
 	groupWG         sync.WaitGroup
-	mPortDispatcher = NewSyncMapPortDispatcher()
+	mAddrDispatcher = NewSyncMapAddrDispatcher()
+	// shutdownWG keeps main from returning before draining finishes
+	shutdownWG sync.WaitGroup
 )
 
-func listenGroup(group *config.Group) {
-	err := listenProtocols(group, protocols[:])
-	if err != nil {
-		mPortDispatcher.Lock()
-		// error but listening
-		if _, ok := mPortDispatcher.Map[group.Port]; ok {
-			log.Fatalln(err)
+// shutdownAddr releases the sockets of an address and drains its dispatchers within timeout.
+func shutdownAddr(t *[len(protocols)]dispatcher.Dispatcher, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range t {
+		if t[i] == nil {
+			continue
 		}
-		mPortDispatcher.Unlock()
+		wg.Add(1)
+		go func(d dispatcher.Dispatcher) {
+			defer wg.Done()
+			_ = d.Shutdown(ctx)
+		}(t[i])
 	}
+	wg.Wait()
+}
+
+// shutdownHandler drains all dispatchers and exits on SIGTERM or SIGINT.
+func shutdownHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	timeout := config.GetConfig().DrainTimeout()
+	log.Printf("Received %v, shutting down within %v", sig, timeout)
+	go func() {
+		// exit immediately on a second signal
+		<-ch
+		log.Fatalln("Forced to exit")
+	}()
+	shutdown(timeout)
 }
 
-func listenProtocols(group *config.Group, protocols []string) error {
-	mPortDispatcher.Lock()
-	if _, ok := mPortDispatcher.Map[group.Port]; !ok {
-		mPortDispatcher.Map[group.Port] = new([2]dispatcher.Dispatcher)
+// shutdown drains all dispatchers within timeout and exits.
+func shutdown(timeout time.Duration) {
+	shutdownWG.Add(1)
+	mAddrDispatcher.Lock()
+	var wg sync.WaitGroup
+	for addr, t := range mAddrDispatcher.Map {
+		delete(mAddrDispatcher.Map, addr)
+		wg.Add(1)
+		go func(t *[len(protocols)]dispatcher.Dispatcher) {
+			defer wg.Done()
+			shutdownAddr(t, timeout)
+		}(t)
 	}
-	t := mPortDispatcher.Map[group.Port]
-	mPortDispatcher.Unlock()
+	mAddrDispatcher.Unlock()
+	wg.Wait()
+	if err := config.Quota().Flush(); err != nil {
+		log.Printf("[warning] failed to save quota usage: %v", err)
+	}
+	log.Println("Exited")
+	os.Exit(0)
+}
 
-	ch := make(chan error, len(protocols))
+// listenAddr listens on addr for the group and serves it in the background. The caller should hold the lock of mAddrDispatcher.
+func listenAddr(group *config.Group, addr config.ListenAddr) error {
+	t := new([len(protocols)]dispatcher.Dispatcher)
 	for i, protocol := range protocols {
-		d, _ := dispatcher.New(protocol, group)
-		(*t)[i] = d
-		go func() {
-			err := d.Listen()
-			ch <- err
-		}()
+		t[i], _ = dispatcher.New(protocol, group, addr)
+		if err := t[i].Bind(); err != nil {
+			for _, d := range t[:i] {
+				_ = d.Close()
+			}
+			return err
+		}
+	}
+	mAddrDispatcher.Map[addr.String()] = t
+	groupWG.Add(1)
+	go func() {
+		defer groupWG.Done()
+		if err := listenProtocols(t); err != nil {
+			log.Printf("[error] listen on %v: %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+func listenProtocols(t *[len(protocols)]dispatcher.Dispatcher) error {
+	ch := make(chan error, len(t))
+	for _, d := range t {
+		go func(d dispatcher.Dispatcher) {
+			ch <- d.Listen()
+		}(d)
 	}
 	return <-ch
 }
 
+// checkActivatedSockets logs the sockets passed by systemd or the old process, and warns about those no group listens on.
+func checkActivatedSockets(conf *config.Config) {
+	for _, s := range activation.Sockets() {
+		if s.Name == metricsSocketName || s.Name == adminSocketName {
+			continue
+		}
+		used := false
+		for i := range conf.Groups {
+			for _, addr := range conf.Groups[i].ListenAddrs() {
+				if conf.Groups[i].MatchSocket(s.Network(), addr)(s) {
+					used = true
+				}
+			}
+		}
+		if used {
+			log.Printf("inherited %v socket %v named %q", s.Network(), s.Addr(), s.Name)
+		} else {
+			log.Printf("[warning] no group listens on inherited %v socket %v named %q", s.Network(), s.Addr(), s.Name)
+		}
+	}
+}
+
+func newAdminServer(conf *config.Config) *admin.Server {
+	return &admin.Server{
+		Token: conf.Admin.Token,
+		Dispatchers: func() []admin.DispatcherInfo {
+			mAddrDispatcher.Lock()
+			defer mAddrDispatcher.Unlock()
+			c := config.GetConfig()
+			infos := make([]admin.DispatcherInfo, 0, len(mAddrDispatcher.Map))
+			for i := range c.Groups {
+				for _, addr := range c.Groups[i].ListenAddrs() {
+					t, ok := mAddrDispatcher.Map[addr.String()]
+					if !ok {
+						continue
+					}
+					info := admin.DispatcherInfo{
+						Addr:  addr.String(),
+						Port:  addr.Port,
+						Group: c.Groups[i].Name,
+					}
+					for j := range protocols {
+						if t[j] != nil {
+							info.Protocols = append(info.Protocols, protocols[j])
+						}
+					}
+					infos = append(infos, info)
+				}
+			}
+			sort.Slice(infos, func(i, j int) bool {
+				if infos[i].Port != infos[j].Port {
+					return infos[i].Port < infos[j].Port
+				}
+				return infos[i].Addr < infos[j].Addr
+			})
+			return infos
+		},
+		Reload: func() (*admin.ReloadResult, error) {
+			return ReloadConfig(conf)
+		},
+		SetServerDisabled: func(group string, server string, disabled bool) int {
+			// avoid racing with reloading
+			mAddrDispatcher.Lock()
+			defer mAddrDispatcher.Unlock()
+			return config.GetConfig().SetServerDisabled(group, server, disabled)
+		},
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "conns" {
+		os.Exit(admin.ConnsCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	conf := config.NewConfig(&http.Client{
 		Timeout: HttpClientTimeout,
 	})
 
+	checkActivatedSockets(conf)
+
 	// handle reload
 	go signalHandler(conf)
+	go upgradeHandler()
+	go shutdownHandler()
+
+	if conf.Metrics.Listen != "" {
+		l, err := listenHTTP(metricsSocketName, conf.Metrics.Listen, func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		metricsListener = l
+		go func() {
+			path := conf.Metrics.Path
+			if path == "" {
+				path = "/metrics"
+			}
+			if err := metrics.Serve(l, path); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
 
-	mPortDispatcher.Lock()
+	if conf.Admin.Listen != "" {
+		l, err := listenHTTP(adminSocketName, conf.Admin.Listen, func(addr string) (net.Listener, error) {
+			return admin.Listen(addr, conf.Admin.Token)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		adminListener = l
+		go func() {
+			if err := newAdminServer(conf).Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
+	mAddrDispatcher.Lock()
 	for i := range conf.Groups {
-		groupWG.Add(1)
-		go func(group *config.Group) {
-			listenGroup(group)
-			groupWG.Done()
-		}(&conf.Groups[i])
+		for _, addr := range conf.Groups[i].ListenAddrs() {
+			if err := listenAddr(&conf.Groups[i], addr); err != nil {
+				log.Fatalln(err)
+			}
+		}
 	}
-	mPortDispatcher.Unlock()
+	mAddrDispatcher.Unlock()
+	conf.StartHealthChecks(nil)
+	// tell the old process on upgrading that sockets are taken
+	activation.Ready()
 	groupWG.Wait()
+	shutdownWG.Wait()
 }
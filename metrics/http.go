@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := r.WriteTo(w); err != nil {
+			log.Printf("[metrics] failed to write metrics: %v", err)
+		}
+	})
+}
+
+// Serve serves DefaultRegistry on the listener at the path.
+func Serve(l net.Listener, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, Handler(DefaultRegistry))
+	log.Printf("[metrics] listen on %v\n", l.Addr())
+	return http.Serve(l, mux)
+}
@@ -0,0 +1,256 @@
+// Package metrics exposes metrics in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type Gauge struct {
+	v uint64 // float64 bits
+}
+
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.v, math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.v)
+		if atomic.CompareAndSwapUint64(&g.v, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.v))
+}
+
+type Histogram struct {
+	upperBounds []float64
+	mu          sync.Mutex
+	buckets     []uint64
+	count       uint64
+	sum         float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.upperBounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// vec is a family of metrics partitioned by label values.
+type vec struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	newMetric  func() interface{}
+	mu         sync.Mutex
+	metrics    map[string]interface{}
+	labels     map[string][]string
+}
+
+func (v *vec) with(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %v expects %v label values, got %v", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.metrics[key]
+	if !ok {
+		m = v.newMetric()
+		v.metrics[key] = m
+		v.labels[key] = append([]string(nil), labelValues...)
+	}
+	return m
+}
+
+// Delete removes the metric with the label values.
+func (v *vec) Delete(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.metrics, key)
+	delete(v.labels, key)
+}
+
+type CounterVec struct{ vec }
+
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.with(labelValues).(*Counter)
+}
+
+type GaugeVec struct{ vec }
+
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.with(labelValues).(*Gauge)
+}
+
+type HistogramVec struct{ vec }
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.with(labelValues).(*Histogram)
+}
+
+// Registry holds metric families in the order of registration.
+type Registry struct {
+	mu   sync.Mutex
+	vecs []*vec
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (r *Registry) register(v *vec) {
+	v.metrics = make(map[string]interface{})
+	v.labels = make(map[string][]string)
+	r.mu.Lock()
+	r.vecs = append(r.vecs, v)
+	r.mu.Unlock()
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{vec{name: name, help: help, typ: typeCounter, labelNames: labelNames, newMetric: func() interface{} {
+		return new(Counter)
+	}}}
+	r.register(&v.vec)
+	return v
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{vec{name: name, help: help, typ: typeGauge, labelNames: labelNames, newMetric: func() interface{} {
+		return new(Gauge)
+	}}}
+	r.register(&v.vec)
+	return v
+}
+
+func (r *Registry) NewHistogramVec(name, help string, upperBounds []float64, labelNames ...string) *HistogramVec {
+	v := &HistogramVec{vec{name: name, help: help, typ: typeHistogram, labelNames: labelNames, newMetric: func() interface{} {
+		return &Histogram{upperBounds: upperBounds, buckets: make([]uint64, len(upperBounds))}
+	}}}
+	r.register(&v.vec)
+	return v
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(names[i] + `="` + labelValueEscaper.Replace(values[i]) + `"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i] + `="` + labelValueEscaper.Replace(extra[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	var b strings.Builder
+	r.mu.Lock()
+	vecs := append([]*vec(nil), r.vecs...)
+	r.mu.Unlock()
+	for _, v := range vecs {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+		v.mu.Lock()
+		keys := make([]string, 0, len(v.metrics))
+		for key := range v.metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			labels := v.labels[key]
+			switch m := v.metrics[key].(type) {
+			case *Counter:
+				fmt.Fprintf(&b, "%s%s %d\n", v.name, formatLabels(v.labelNames, labels), m.Value())
+			case *Gauge:
+				fmt.Fprintf(&b, "%s%s %s\n", v.name, formatLabels(v.labelNames, labels), formatFloat(m.Value()))
+			case *Histogram:
+				m.mu.Lock()
+				for i, bound := range m.upperBounds {
+					fmt.Fprintf(&b, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, labels, "le", formatFloat(bound)), m.buckets[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, labels, "le", "+Inf"), m.count)
+				fmt.Fprintf(&b, "%s_sum%s %s\n", v.name, formatLabels(v.labelNames, labels), formatFloat(m.sum))
+				fmt.Fprintf(&b, "%s_count%s %d\n", v.name, formatLabels(v.labelNames, labels), m.count)
+				m.mu.Unlock()
+			}
+		}
+		v.mu.Unlock()
+	}
+	m, err := io.WriteString(w, b.String())
+	return int64(m), err
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "A counter.", "group")
+	g := r.NewGaugeVec("test_gauge", "A gauge.")
+	h := r.NewHistogramVec("test_depth", "A histogram.", []float64{1, 10}, "group")
+
+	c.With("b").Inc()
+	c.With(`a"\`).Add(3)
+	g.With().Set(1.5)
+	g.With().Dec()
+	h.With("a").Observe(1)
+	h.With("a").Observe(5)
+	h.With("a").Observe(50)
+
+	var b strings.Builder
+	r.WriteTo(&b)
+	expect := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{group="a\"\\"} 3
+test_total{group="b"} 1
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 0.5
+# HELP test_depth A histogram.
+# TYPE test_depth histogram
+test_depth_bucket{group="a",le="1"} 1
+test_depth_bucket{group="a",le="10"} 2
+test_depth_bucket{group="a",le="+Inf"} 3
+test_depth_sum{group="a"} 56
+test_depth_count{group="a"} 3
+`
+	if b.String() != expect {
+		t.Errorf("expect:\n%v\ngot:\n%v", expect, b.String())
+	}
+
+	c.Delete(`a"\`)
+	b.Reset()
+	r.WriteTo(&b)
+	if strings.Contains(b.String(), `test_total{group="a`) {
+		t.Errorf("the deleted metric should not be written:\n%v", b.String())
+	}
+}
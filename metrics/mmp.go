@@ -0,0 +1,62 @@
+package metrics
+
+// DefaultRegistry holds the metrics of mmp-go.
+var DefaultRegistry = NewRegistry()
+
+var (
+	GroupConnections = DefaultRegistry.NewCounterVec("mmp_group_connections_total",
+		"Accepted TCP connections and new UDP sessions of the group.", "group", "protocol")
+	GroupAuthSuccesses = DefaultRegistry.NewCounterVec("mmp_group_auth_successes_total",
+		"Connections and UDP sessions of the group that passed auth.", "group", "protocol")
+	GroupAuthFailures = DefaultRegistry.NewCounterVec("mmp_group_auth_failures_total",
+		"Connections and UDP sessions of the group that failed auth.", "group", "protocol")
+	GroupReplays = DefaultRegistry.NewCounterVec("mmp_group_replays_total",
+		"Connections and UDP sessions of the group rejected by the replay filter.", "group", "protocol")
+	GroupFallbacks = DefaultRegistry.NewCounterVec("mmp_group_fallbacks_total",
+		"TCP connections and UDP sessions of the group that failed auth and were sent to the fallback.", "group")
+	GroupDrains = DefaultRegistry.NewCounterVec("mmp_group_drains_total",
+		"TCP connections of the group that failed auth and were drained.", "group")
+	GroupTCPTimeouts = DefaultRegistry.NewCounterVec("mmp_group_tcp_timeouts_total",
+		"Relayed TCP connections of the group closed by the timeout: idle, lifetime or half-close.", "group", "timeout")
+	GroupLimitRejections = DefaultRegistry.NewCounterVec("mmp_group_limit_rejections_total",
+		"TCP connections and UDP sessions of the group rejected by the limit: group, ip or rate.", "group", "protocol", "limit")
+	GroupRejections = DefaultRegistry.NewCounterVec("mmp_group_rejections_total",
+		"TCP connections of the group that failed auth and were handled by the auth failure policy other than fallback.", "group", "policy")
+
+	ServerTCPConnections = DefaultRegistry.NewGaugeVec("mmp_server_tcp_connections",
+		"Active TCP connections relayed to the server.", "group", "server")
+	ServerUDPSessions = DefaultRegistry.NewGaugeVec("mmp_server_udp_sessions",
+		"Active UDP sessions relayed to the server.", "group", "server")
+	ServerBytes = DefaultRegistry.NewCounterVec("mmp_server_bytes_total",
+		"Bytes relayed between clients and the server. Upload is from clients to the server.", "group", "server", "protocol", "direction")
+
+	TargetDialFailures = DefaultRegistry.NewCounterVec("mmp_target_dial_failures_total",
+		"Failed dials to the target of servers in the group.", "group", "target", "protocol")
+	TargetHealthy = DefaultRegistry.NewGaugeVec("mmp_target_healthy",
+		"Whether the target of servers in the group passes health checks.", "group", "target")
+
+	AuthProbeDepth = DefaultRegistry.NewHistogramVec("mmp_auth_probe_depth",
+		"Number of servers probed before auth found a hit.", []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}, "group", "protocol")
+
+	UpstreamPullSuccess = DefaultRegistry.NewGaugeVec("mmp_upstream_pull_success",
+		"Whether the last pull from the upstream succeeded.", "group", "upstream")
+	UpstreamPullTimestamp = DefaultRegistry.NewGaugeVec("mmp_upstream_pull_timestamp_seconds",
+		"Unix time of the last pull from the upstream.", "group", "upstream")
+)
+
+// DeleteServer removes the metrics of a server removed from the group.
+func DeleteServer(group, server string) {
+	ServerTCPConnections.Delete(group, server)
+	ServerUDPSessions.Delete(group, server)
+	for _, protocol := range []string{"tcp", "udp"} {
+		for _, direction := range []string{"up", "down"} {
+			ServerBytes.Delete(group, server, protocol, direction)
+		}
+	}
+}
+
+// DeleteUpstream removes the metrics of an upstream removed from the group.
+func DeleteUpstream(group, upstream string) {
+	UpstreamPullSuccess.Delete(group, upstream)
+	UpstreamPullTimestamp.Delete(group, upstream)
+}
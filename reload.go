@@ -2,14 +2,25 @@ package main
 
 import (
 	"log"
+	"sort"
 
+	"github.com/Qv2ray/mmp-go/admin"
 	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/metrics"
 )
 
-func ReloadConfig(oldConf *config.Config) {
+func ReloadConfig(oldConf *config.Config) (*admin.ReloadResult, error) {
 	log.Println("Reloading configuration")
-	mPortDispatcher.Lock()
-	defer mPortDispatcher.Unlock()
+	mAddrDispatcher.Lock()
+	defer mAddrDispatcher.Unlock()
+	// keep main from returning between releasing the removed addresses and listening on the added ones
+	groupWG.Add(1)
+	defer groupWG.Done()
+
+	// compare with the configuration in use rather than the one at startup
+	if c := config.GetConfig(); c != nil {
+		oldConf = c
+	}
 
 	// rebuild config
 	confPath := oldConf.ConfPath
@@ -17,8 +28,9 @@ func ReloadConfig(oldConf *config.Config) {
 	newConf, err := config.BuildConfig(confPath, httpClient)
 	if err != nil {
 		log.Printf("failed to reload configuration: %v", err)
-		return
+		return nil, err
 	}
+	result := new(admin.ReloadResult)
 	// check if there is any net error when pulling the upstream configurations
 	for i := range newConf.Groups {
 		newGroup := &newConf.Groups[i]
@@ -27,18 +39,15 @@ func ReloadConfig(oldConf *config.Config) {
 			pErr := newUpstream.PullingError
 			if pErr != nil {
 				log.Printf("skip to update some servers in group %v , error on upstream %v: %v", newGroup.Name, newUpstream.Name, pErr)
+				result.UpstreamErrors = append(result.UpstreamErrors, admin.UpstreamError{
+					Group:    newGroup.Name,
+					Upstream: newUpstream.Name,
+					Error:    pErr.Error(),
+				})
 				// error occurred, remain those servers
 
-				// find the group in the oldConf
-				var oldGroup *config.Group
-				for k := range oldConf.Groups {
-					// they should have the same port
-					if oldConf.Groups[k].Port != newGroup.Port {
-						continue
-					}
-					oldGroup = &oldConf.Groups[k]
-					break
-				}
+				// find the group in the oldConf, which should listen on a same address
+				oldGroup := newGroup.FindGroup(oldConf.Groups)
 				if oldGroup == nil {
 					// cannot find the corresponding old group
 					continue
@@ -53,38 +62,94 @@ func ReloadConfig(oldConf *config.Config) {
 				}
 			}
 		}
+		// index the remained servers
+		newGroup.BuildIdentities()
+		newGroup.BuildTCPHeaderLen()
+		newGroup.BuildDisabledServers()
+		newGroup.BuildTargets()
+		// remember salts and connections across reloads
+		if oldGroup := newGroup.FindGroup(oldConf.Groups); oldGroup != nil {
+			newGroup.InheritReplayFilter(oldGroup)
+			newGroup.InheritLimiter(oldGroup)
+			newGroup.InheritShaper(oldGroup)
+			newGroup.InheritTargets(oldGroup)
+		}
 	}
 	config.SetConfig(newConf)
 	c := newConf
+	c.StartHealthChecks(oldConf)
+	deleteRemovedMetrics(oldConf, c)
 
-	// update dispatchers
-	newConfPortSet := make(map[int]struct{})
+	// release the removed addresses first, which may overlap the added ones, e.g. ":443" and "192.0.2.1:443"
+	newConfAddrSet := make(map[string]struct{})
 	for i := range c.Groups {
-		newConfPortSet[c.Groups[i].Port] = struct{}{}
-
-		if t, ok := mPortDispatcher.Map[c.Groups[i].Port]; ok {
-			// update the existing dispatcher
+		for _, addr := range c.Groups[i].ListenAddrs() {
+			newConfAddrSet[addr.String()] = struct{}{}
+		}
+	}
+	for addr, t := range mAddrDispatcher.Map {
+		if _, ok := newConfAddrSet[addr]; !ok {
+			delete(mAddrDispatcher.Map, addr)
+			result.RemovedAddrs = append(result.RemovedAddrs, addr)
 			for j := range protocols {
-				t[j].UpdateGroup(&c.Groups[i])
+				_ = t[j].Unlisten()
 			}
-		} else {
-			// add a new port dispatcher
-			groupWG.Add(1)
-			go func(group *config.Group) {
-				listenGroup(group)
-				groupWG.Done()
-			}(&c.Groups[i])
+			go shutdownAddr(t, c.DrainTimeout())
 		}
 	}
-	// close all removed port dispatcher
-	for port := range mPortDispatcher.Map {
-		if _, ok := newConfPortSet[port]; !ok {
-			t := mPortDispatcher.Map[port]
-			delete(mPortDispatcher.Map, port)
-			for j := range protocols {
-				_ = (*t)[j].Close()
+	// update dispatchers
+	for i := range c.Groups {
+		result.Servers += len(c.Groups[i].Servers)
+		for _, addr := range c.Groups[i].ListenAddrs() {
+			key := addr.String()
+			if t, ok := mAddrDispatcher.Map[key]; ok {
+				result.UpdatedAddrs = append(result.UpdatedAddrs, key)
+				// update the existing dispatcher
+				for j := range protocols {
+					t[j].UpdateGroup(&c.Groups[i])
+				}
+			} else if err := listenAddr(&c.Groups[i], addr); err != nil {
+				// keep the other addresses serving
+				log.Printf("[error] failed to listen on %v for group %v: %v", key, c.Groups[i].Name, err)
+				result.ListenErrors = append(result.ListenErrors, admin.ListenError{
+					Group: c.Groups[i].Name,
+					Addr:  key,
+					Error: err.Error(),
+				})
+			} else {
+				// add a new address dispatcher
+				result.AddedAddrs = append(result.AddedAddrs, key)
 			}
 		}
 	}
+	result.Groups = len(c.Groups)
+	sort.Strings(result.RemovedAddrs)
 	log.Println("Reloaded configuration")
+	return result, nil
+}
+
+// deleteRemovedMetrics removes the metrics of servers and upstreams not in the new configuration.
+func deleteRemovedMetrics(oldConf, newConf *config.Config) {
+	servers := make(map[[2]string]struct{})
+	upstreams := make(map[[2]string]struct{})
+	for _, g := range newConf.Groups {
+		for _, s := range g.Servers {
+			servers[[2]string{g.Name, s.Name}] = struct{}{}
+		}
+		for _, u := range g.Upstreams {
+			upstreams[[2]string{g.Name, u.Name}] = struct{}{}
+		}
+	}
+	for _, g := range oldConf.Groups {
+		for _, s := range g.Servers {
+			if _, ok := servers[[2]string{g.Name, s.Name}]; !ok {
+				metrics.DeleteServer(g.Name, s.Name)
+			}
+		}
+		for _, u := range g.Upstreams {
+			if _, ok := upstreams[[2]string{g.Name, u.Name}]; !ok {
+				metrics.DeleteUpstream(g.Name, u.Name)
+			}
+		}
+	}
 }
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,3 +19,12 @@ func signalHandler(oldConf *config.Config) {
 		ReloadConfig(oldConf)
 	}
 }
+
+func upgradeHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	for range ch {
+		log.Println("Received SIGUSR2, upgrading")
+		upgradeAndExit()
+	}
+}
@@ -10,3 +10,7 @@ import (
 func signalHandler(*config.Config) {
 	log.Println(`Signal-triggered configuration reloading is not supported on Windows`)
 }
+
+func upgradeHandler() {
+	log.Println(`Signal-triggered upgrading is not supported on Windows`)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/mmp-go/config"
+	"github.com/Qv2ray/mmp-go/dispatcher"
+	"github.com/Qv2ray/mmp-go/infra/activation"
+)
+
+const (
+	// UpgradeReadyTimeout limits how long to wait for the new process to load the config and take the sockets.
+	UpgradeReadyTimeout = time.Minute
+
+	metricsSocketName = "mmp-go.metrics"
+	adminSocketName   = "mmp-go.admin"
+)
+
+var (
+	metricsListener net.Listener
+	adminListener   net.Listener
+	upgradeMutex    sync.Mutex
+)
+
+// listenHTTP takes the socket with the name handed over by the old process, or listens on addr by listen.
+func listenHTTP(name string, addr string, listen func(addr string) (net.Listener, error)) (net.Listener, error) {
+	l, _, err := activation.TakeListener(func(s *activation.Socket) bool {
+		return s.Name == name
+	})
+	if err != nil || l != nil {
+		return l, err
+	}
+	return listen(addr)
+}
+
+// upgrade starts the executable, which may have been replaced by a new version, with all listening sockets.
+// Once the new process is ready, the old one stops accepting, drains active connections and exits.
+func upgrade() error {
+	upgradeMutex.Lock()
+	defer upgradeMutex.Unlock()
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(f *os.File, name string) {
+		if strings.Contains(name, ":") {
+			// the name is only needed by groups listening on sockets named after them, which cannot contain ':'
+			name = ""
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+	for _, l := range []struct {
+		listener net.Listener
+		name     string
+	}{{metricsListener, metricsSocketName}, {adminListener, adminSocketName}} {
+		// the new process replaces unix sockets by itself
+		if tl, ok := l.listener.(*net.TCPListener); ok {
+			f, err := tl.File()
+			if err != nil {
+				return err
+			}
+			add(f, l.name)
+		}
+	}
+
+	// the dispatchers keep their sockets until the new process is ready
+	var handedOver []dispatcher.Dispatcher
+	mAddrDispatcher.Lock()
+	conf := config.GetConfig()
+	for i := range conf.Groups {
+		for _, addr := range conf.Groups[i].ListenAddrs() {
+			t, ok := mAddrDispatcher.Map[addr.String()]
+			if !ok {
+				continue
+			}
+			for _, d := range t {
+				fs, err := d.Files()
+				if err != nil {
+					mAddrDispatcher.Unlock()
+					return fmt.Errorf("%v: %w", addr, err)
+				}
+				for _, f := range fs {
+					add(f, conf.Groups[i].Name)
+				}
+				handedOver = append(handedOver, d)
+			}
+		}
+	}
+	mAddrDispatcher.Unlock()
+
+	// the new process loads the usage at startup, while the traffic of draining is added to the file on exit
+	if err = config.Quota().Flush(); err != nil {
+		log.Printf("[warning] failed to save quota usage: %v", err)
+	}
+	log.Printf("Upgrading: starting %v with %d sockets", path, len(files))
+	p, err := activation.Handover(path, os.Args[1:], files, names, UpgradeReadyTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Upgrading: process %d is ready", p.Pid)
+	for _, d := range handedOver {
+		d.HandOver()
+	}
+	return nil
+}
+
+// upgradeAndExit upgrades, and drains and exits if succeeded.
+func upgradeAndExit() {
+	if err := upgrade(); err != nil {
+		log.Printf("failed to upgrade: %v", err)
+		return
+	}
+	for _, l := range []net.Listener{metricsListener, adminListener} {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// the socket file belongs to the new process now
+			ul.SetUnlinkOnClose(false)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+	shutdown(config.GetConfig().DrainTimeout())
+}